@@ -0,0 +1,83 @@
+// Command lotus-cluster-state reads and writes raft consensus state
+// directly in the on-disk Raft data folder, with the node stopped. It
+// is the IPFS-Cluster-style "cluster state" tool adapted to lotus's
+// Raft-backed consensus component (lib/consensus/raft): dump exports the
+// NonceMap/MsgUuids of the newest snapshot as JSON, restore loads a dump
+// back in as a fresh snapshot, and clean wipes the Raft log and snapshots.
+// dump does not read the Raft log, and it can only decode snapshots that
+// restore wrote, not ones a running node wrote.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli/v2"
+
+	consensus "github.com/filecoin-project/lotus/lib/consensus/raft"
+)
+
+func main() {
+	app := &cli.App{
+		Name:  "lotus-cluster-state",
+		Usage: "inspect and migrate lotus Raft consensus state offline",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "data-folder",
+				Usage:    "path to the Raft data folder (raft.db + snapshots/)",
+				Required: true,
+			},
+		},
+		Commands: []*cli.Command{
+			dumpCmd,
+			restoreCmd,
+			cleanCmd,
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "lotus-cluster-state: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func raftConfig(cctx *cli.Context) *consensus.ClusterRaftConfig {
+	return &consensus.ClusterRaftConfig{
+		DataFolder: cctx.String("data-folder"),
+	}
+}
+
+var dumpCmd = &cli.Command{
+	Name:  "dump",
+	Usage: "dump the state in the newest Raft snapshot (as written by `restore`) as JSON to stdout",
+	Action: func(cctx *cli.Context) error {
+		return consensus.DumpOfflineState(raftConfig(cctx), os.Stdout)
+	},
+}
+
+var restoreCmd = &cli.Command{
+	Name:      "restore",
+	Usage:     "load a JSON dump (from `dump`) back in as a fresh Raft snapshot",
+	ArgsUsage: "<dump.json>",
+	Action: func(cctx *cli.Context) error {
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("restore expects exactly one argument: the dump file path")
+		}
+
+		f, err := os.Open(cctx.Args().First())
+		if err != nil {
+			return err
+		}
+		defer f.Close() // nolint
+
+		return consensus.ImportOfflineState(raftConfig(cctx), f)
+	},
+}
+
+var cleanCmd = &cli.Command{
+	Name:  "clean",
+	Usage: "remove the Raft log and all snapshots under --data-folder",
+	Action: func(cctx *cli.Context) error {
+		return consensus.CleanOffline(raftConfig(cctx))
+	},
+}
@@ -0,0 +1,355 @@
+package stores
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// FetchConfig controls the resumable/parallel fetch behavior of Remote. The
+// zero value is not usable; use DefaultFetchConfig() and override the
+// fields that matter, or pass nil to NewRemote to get the default.
+type FetchConfig struct {
+	// Parallelism is the number of ranged GETs a single fetch splits into
+	// when the remote advertises Accept-Ranges.
+	Parallelism int
+
+	// ChunkSize is the size of each ranged GET. Sector files are multi-GiB,
+	// so this defaults to a large chunk to avoid thousands of small range
+	// requests.
+	ChunkSize int64
+
+	// MaxRetries bounds how many times a single range is retried before
+	// the whole fetch gives up.
+	MaxRetries int
+
+	// RetryBackoff is the delay before retrying a failed range.
+	RetryBackoff time.Duration
+
+	// RaceWidth is how many health-ranked candidate sources acquireFromRemote
+	// fetches from concurrently before falling back to the next-best wave;
+	// the first to succeed wins and the rest are discarded.
+	RaceWidth int
+
+	// CacheDir is where Remote.Reader's on-disk range cache keeps the hot
+	// chunks it has fetched from remote storage. Empty means
+	// filepath.Join(os.TempDir(), FetchTempSubdir, "range-cache"). This is
+	// under the system temp dir, not the per-storage-path FetchTempSubdir
+	// that acquireFromRemote stages full sector files under.
+	CacheDir string
+
+	// CacheBudgetBytes bounds how much disk the range cache may use before
+	// it starts evicting the least-recently-used chunks.
+	CacheBudgetBytes int64
+
+	// CacheMinFreeBytes is a floor on free disk space on the filesystem
+	// backing CacheDir: independent of CacheBudgetBytes, the cache evicts
+	// down further whenever free space drops below this, so a long-running
+	// cache fill can't starve an ongoing AcquireSector fetch's local.Reserve
+	// of the room it needs on the same filesystem.
+	CacheMinFreeBytes int64
+
+	// CacheChunkSize is the granularity the range cache fetches and stores
+	// remote piece data in.
+	CacheChunkSize int64
+
+	// PrefetchChunks is how many chunks past the one just read Remote.Reader
+	// fetches in the background, anticipating a sequential read.
+	PrefetchChunks int
+}
+
+// DefaultFetchConfig returns Remote's default knobs: 4-way parallelism in
+// 64MiB chunks, 5 retries per range, and races of 2 sources.
+func DefaultFetchConfig() *FetchConfig {
+	return &FetchConfig{
+		Parallelism:  4,
+		ChunkSize:    64 << 20,
+		MaxRetries:   5,
+		RetryBackoff: 2 * time.Second,
+		RaceWidth:    2,
+
+		CacheBudgetBytes:  1 << 30, // 1GiB
+		CacheMinFreeBytes: 5 << 30, // 5GiB
+		CacheChunkSize:    4 << 20, // 4MiB
+		PrefetchChunks:    4,
+	}
+}
+
+// byteRange is one [Start, End) span of a fetch, used both to describe work
+// to a download worker and to record progress in a .part sidecar.
+type byteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"` // exclusive
+}
+
+// fetchPartState is the sidecar written next to an in-progress temp file so
+// a worker restart can resume a multi-GiB transfer instead of starting it
+// over from zero. It is intentionally tiny (a list of completed ranges) so
+// it can be rewritten wholesale after every completed range.
+type fetchPartState struct {
+	URL       string      `json:"url"`
+	Size      int64       `json:"size"`
+	Completed []byteRange `json:"completed"`
+}
+
+func partSidecarPath(outname string) string {
+	return outname + ".part"
+}
+
+func loadPartState(outname, url string, size int64) *fetchPartState {
+	b, err := os.ReadFile(partSidecarPath(outname))
+	if err != nil {
+		return &fetchPartState{URL: url, Size: size}
+	}
+
+	var st fetchPartState
+	if err := json.Unmarshal(b, &st); err != nil || st.URL != url || st.Size != size {
+		// Stale or corrupt sidecar (e.g. left over from a fetch of a
+		// different URL/size that reused outname) - start fresh rather
+		// than risk assembling a file from the wrong ranges.
+		return &fetchPartState{URL: url, Size: size}
+	}
+	return &st
+}
+
+func (st *fetchPartState) save(outname string) {
+	b, err := json.Marshal(st)
+	if err != nil {
+		log.Warnf("marshaling fetch part state for %s: %+v", outname, err)
+		return
+	}
+	if err := os.WriteFile(partSidecarPath(outname), b, 0644); err != nil {
+		log.Warnf("writing fetch part state for %s: %+v", outname, err)
+	}
+}
+
+func (st *fetchPartState) markDone(r byteRange) {
+	st.Completed = append(st.Completed, r)
+}
+
+// missingRanges returns the sub-ranges of [0, size) not already present in
+// st.Completed, split into chunks no larger than chunkSize.
+func (st *fetchPartState) missingRanges(chunkSize int64) []byteRange {
+	covered := make([]byteRange, len(st.Completed))
+	copy(covered, st.Completed)
+	// Ranges are recorded in completion order, which parallel workers don't
+	// keep in offset order; the cursor walk below needs them sorted.
+	sort.Slice(covered, func(i, j int) bool { return covered[i].Start < covered[j].Start })
+
+	var missing []byteRange
+	cursor := int64(0)
+	for _, r := range covered {
+		if r.Start > cursor {
+			missing = append(missing, byteRange{Start: cursor, End: r.Start})
+		}
+		if r.End > cursor {
+			cursor = r.End
+		}
+	}
+	if cursor < st.Size {
+		missing = append(missing, byteRange{Start: cursor, End: st.Size})
+	}
+
+	var chunked []byteRange
+	for _, r := range missing {
+		for s := r.Start; s < r.End; s += chunkSize {
+			e := s + chunkSize
+			if e > r.End {
+				e = r.End
+			}
+			chunked = append(chunked, byteRange{Start: s, End: e})
+		}
+	}
+	return chunked
+}
+
+// parseContentRangeSize extracts the total size from a "bytes 0-0/1234"
+// Content-Range header value.
+func parseContentRangeSize(cr string) (int64, bool) {
+	i := len(cr) - 1
+	for i >= 0 && cr[i] != '/' {
+		i--
+	}
+	if i < 0 || i == len(cr)-1 {
+		return 0, false
+	}
+	if cr[i+1:] == "*" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(cr[i+1:], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+func newDigestHash(digest string) (hash.Hash, string, bool) {
+	const prefix = "sha256:"
+	if len(digest) <= len(prefix) || digest[:len(prefix)] != prefix {
+		return nil, "", false
+	}
+	return sha256.New(), digest[len(prefix):], true
+}
+
+// fetchRanged downloads url into outname using up to cfg.Parallelism
+// concurrent ranged GETs against ht, resuming from outname's .part sidecar
+// if one exists from a previous (interrupted) attempt. On success it
+// verifies the digest ht.Head found, if any, and removes the sidecar.
+func (r *Remote) fetchRanged(ctx context.Context, ht *httpTransport, url string, outname string, probe TransportInfo) error {
+	f, err := os.OpenFile(outname, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return xerrors.Errorf("creating fetch dest: %w", err)
+	}
+	defer f.Close() // nolint
+
+	if err := f.Truncate(probe.Size); err != nil {
+		return xerrors.Errorf("preallocating fetch dest: %w", err)
+	}
+
+	state := loadPartState(outname, url, probe.Size)
+
+	chunks := state.missingRanges(r.fetchCfg.ChunkSize)
+	if len(chunks) == 0 {
+		log.Infof("fetch %s -> %s: all ranges already present, resuming from sidecar", url, outname)
+	}
+
+	type result struct {
+		rng byteRange
+		err error
+	}
+
+	work := make(chan byteRange)
+	results := make(chan result)
+
+	workers := r.fetchCfg.Parallelism
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for rng := range work {
+				results <- result{rng: rng, err: r.fetchRangeWithRetry(ctx, ht, url, f, rng)}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(work)
+		for _, c := range chunks {
+			select {
+			case work <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var firstErr error
+	for range chunks {
+		res := <-results
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		state.markDone(res.rng)
+		state.save(outname)
+	}
+	close(results)
+
+	if firstErr != nil {
+		return xerrors.Errorf("fetching ranges of %s: %w", url, firstErr)
+	}
+
+	if err := f.Sync(); err != nil {
+		return xerrors.Errorf("syncing fetch dest: %w", err)
+	}
+
+	if err := verifyDigest(outname, probe.Digest); err != nil {
+		return err
+	}
+
+	if err := os.Remove(partSidecarPath(outname)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("removing fetch part sidecar for %s: %+v", outname, err)
+	}
+
+	return nil
+}
+
+func (r *Remote) fetchRangeWithRetry(ctx context.Context, ht *httpTransport, url string, f *os.File, rng byteRange) error {
+	var lastErr error
+	for attempt := 0; attempt <= r.fetchCfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(r.fetchCfg.RetryBackoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		select {
+		case r.limit <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		err := r.fetchRangeOnce(ctx, ht, url, f, rng)
+		<-r.limit
+
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		log.Warnf("fetching range [%d,%d) of %s (attempt %d/%d): %+v", rng.Start, rng.End, url, attempt+1, r.fetchCfg.MaxRetries+1, err)
+	}
+	return lastErr
+}
+
+func (r *Remote) fetchRangeOnce(ctx context.Context, ht *httpTransport, url string, f *os.File, rng byteRange) error {
+	body, err := ht.RangeRead(ctx, url, rng.Start, rng.End-rng.Start)
+	if err != nil {
+		return err
+	}
+	defer body.Close() // nolint
+
+	if _, err := io.Copy(io.NewOffsetWriter(f, rng.Start), body); err != nil {
+		return xerrors.Errorf("copying range body: %w", err)
+	}
+	return nil
+}
+
+// verifyDigest re-hashes outname and compares it against a "sha256:<hex>"
+// digest string. An empty digest (the remote didn't send one) is treated as
+// nothing to verify, since not every storage worker implementation will
+// support the Digest header on day one.
+func verifyDigest(outname, digest string) error {
+	h, want, ok := newDigestHash(digest)
+	if !ok {
+		return nil
+	}
+
+	f, err := os.Open(outname)
+	if err != nil {
+		return xerrors.Errorf("opening fetched file for checksum: %w", err)
+	}
+	defer f.Close() // nolint
+
+	if _, err := io.Copy(h, f); err != nil {
+		return xerrors.Errorf("hashing fetched file: %w", err)
+	}
+
+	got := hex.EncodeToString(h.Sum(nil))
+	if got != want {
+		return xerrors.Errorf("checksum mismatch for %s: got %s, want %s", outname, got, want)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package stores
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+// CacheStats is a point-in-time snapshot of Remote's on-disk range cache
+// usage, returned by Remote.CacheStats() alongside FsStat for operational
+// visibility into how effective the cache is for a given workload.
+type CacheStats struct {
+	Hits   int64
+	Misses int64
+	Bytes  int64
+	Budget int64
+}
+
+// rangeCache is an on-disk, size-bounded, least-recently-used cache of byte
+// ranges ("chunks") fetched from remote sector storage, keyed by (url, read
+// range, chunk index within that range). It exists to back remoteRangeReader: re-reading a piece's already
+// seen bytes (common with seeking/CBOR framing readers) shouldn't have to
+// go back to the network.
+//
+// Unlike AcquireSector's local storage, a single piece read has no
+// associated storageID to call Local.Reserve against directly - there is no
+// local sector copy being created at all. So instead of threading through
+// the storage subsystem's space reservation, the cache bounds itself to its
+// own configured byte budget (CacheBudgetBytes) and additionally backs off
+// using minFree: a floor on the cache directory filesystem's free space,
+// below which the cache evicts regardless of whether it's under budget.
+// Since an ongoing AcquireSector fetch's local.Reserve call claims space on
+// that same filesystem, respecting minFree keeps the cache from filling the
+// disk out from under it.
+type rangeCache struct {
+	mu      sync.Mutex
+	dir     string
+	budget  int64
+	minFree int64
+	used    int64
+	sizes   map[string]int64
+	lru     []string // most-recently-used first
+
+	hits   int64
+	misses int64
+}
+
+func newRangeCache(dir string, budget, minFree int64) (*rangeCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, xerrors.Errorf("creating range cache dir: %w", err)
+	}
+
+	return &rangeCache{
+		dir:     dir,
+		budget:  budget,
+		minFree: minFree,
+		sizes:   map[string]int64{},
+	}, nil
+}
+
+// cacheKey returns a filesystem-safe key for chunk chunkIdx of the range
+// [base, base+size) of url. Chunk indexes are relative to base, so base and
+// size are part of the key: readers of different ranges of the same file
+// must not share chunks.
+func cacheKey(url string, base, size, chunkIdx int64) string {
+	h := sha256.Sum256([]byte(url))
+	return fmt.Sprintf("%x-%d-%d-%d", h[:8], base, size, chunkIdx)
+}
+
+func (c *rangeCache) path(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+func (c *rangeCache) touch(key string) {
+	for i, k := range c.lru {
+		if k == key {
+			c.lru = append(c.lru[:i], c.lru[i+1:]...)
+			break
+		}
+	}
+	c.lru = append([]string{key}, c.lru...)
+}
+
+// get returns the on-disk path for key if it's cached, bumping it to
+// most-recently-used.
+func (c *rangeCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.sizes[key]; !ok {
+		c.misses++
+		return "", false
+	}
+
+	c.touch(key)
+	c.hits++
+	return c.path(key), true
+}
+
+// put writes data under key, evicting least-recently-used chunks as needed
+// to stay within budget, and returns the chunk's on-disk path.
+func (c *rangeCache) put(key string, data []byte) (string, error) {
+	p := c.path(key)
+
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return "", xerrors.Errorf("writing cache chunk: %w", err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return "", xerrors.Errorf("renaming cache chunk: %w", err)
+	}
+
+	c.mu.Lock()
+	if _, exists := c.sizes[key]; !exists {
+		c.sizes[key] = int64(len(data))
+		c.used += int64(len(data))
+	}
+	c.touch(key)
+	c.evict()
+	c.mu.Unlock()
+
+	return p, nil
+}
+
+// evict removes least-recently-used chunks until c.used is back under
+// budget and the cache dir's filesystem has at least c.minFree free, or
+// until there's nothing left to evict. Must be called with c.mu held.
+func (c *rangeCache) evict() {
+	for len(c.lru) > 0 && (c.used > c.budget || c.belowMinFree()) {
+		victim := c.lru[len(c.lru)-1]
+		c.lru = c.lru[:len(c.lru)-1]
+
+		sz, ok := c.sizes[victim]
+		if !ok {
+			continue
+		}
+		if err := os.Remove(c.path(victim)); err != nil && !os.IsNotExist(err) {
+			log.Warnf("evicting range cache chunk %s: %+v", victim, err)
+		}
+		c.used -= sz
+		delete(c.sizes, victim)
+	}
+}
+
+// belowMinFree reports whether the filesystem backing c.dir currently has
+// less than c.minFree bytes free. A stat failure is treated as "not below
+// the floor" - the cache's own byte budget is still enforced either way, so
+// losing the ability to query free space just falls back to that.
+func (c *rangeCache) belowMinFree() bool {
+	if c.minFree <= 0 {
+		return false
+	}
+
+	var stat unix.Statfs_t
+	if err := unix.Statfs(c.dir, &stat); err != nil {
+		log.Warnf("statfs %s for range cache min-free check: %+v", c.dir, err)
+		return false
+	}
+
+	free := int64(stat.Bavail) * int64(stat.Bsize)
+	return free < c.minFree
+}
+
+func (c *rangeCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		Hits:   c.hits,
+		Misses: c.misses,
+		Bytes:  c.used,
+		Budget: c.budget,
+	}
+}
+
+// CacheStats returns Remote's on-disk range cache hit/miss/usage stats.
+func (r *Remote) CacheStats() CacheStats {
+	return r.rangeCache.Stats()
+}
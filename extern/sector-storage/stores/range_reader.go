@@ -0,0 +1,189 @@
+package stores
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// remoteRangeReader is an io.ReadCloser/io.ReaderAt/io.Seeker over
+// [base, base+size) of a remote sector file, backed by Remote's on-disk
+// rangeCache. Reads are served chunk-by-chunk (rr.chunkSize granularity);
+// a miss fetches that one chunk via transport.RangeRead and caches it, so a
+// seeking reader (e.g. a piece's CBOR/CAR framing) re-reading earlier bytes
+// doesn't have to go back to the network. Every ReadAt also kicks off
+// background prefetch of the next few chunks, anticipating the common case
+// of a sequential read.
+type remoteRangeReader struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	transport SectorTransport
+	url       string
+	base      int64
+	size      int64
+	pos       int64
+
+	cache     *rangeCache
+	chunkSize int64
+	prefetchN int
+
+	prefetchMu sync.Mutex
+	prefetched map[int64]bool
+}
+
+func newRemoteRangeReader(ctx context.Context, transport SectorTransport, url string, base, size int64, cache *rangeCache, chunkSize int64, prefetchN int) *remoteRangeReader {
+	rctx, cancel := context.WithCancel(ctx)
+	return &remoteRangeReader{
+		ctx:        rctx,
+		cancel:     cancel,
+		transport:  transport,
+		url:        url,
+		base:       base,
+		size:       size,
+		cache:      cache,
+		chunkSize:  chunkSize,
+		prefetchN:  prefetchN,
+		prefetched: map[int64]bool{},
+	}
+}
+
+func (rr *remoteRangeReader) Read(p []byte) (int, error) {
+	n, err := rr.ReadAt(p, rr.pos)
+	rr.pos += int64(n)
+	return n, err
+}
+
+func (rr *remoteRangeReader) Seek(offset int64, whence int) (int64, error) {
+	var newPos int64
+	switch whence {
+	case io.SeekStart:
+		newPos = offset
+	case io.SeekCurrent:
+		newPos = rr.pos + offset
+	case io.SeekEnd:
+		newPos = rr.size + offset
+	default:
+		return 0, xerrors.Errorf("remoteRangeReader.Seek: invalid whence %d", whence)
+	}
+	if newPos < 0 {
+		return 0, xerrors.Errorf("remoteRangeReader.Seek: negative position")
+	}
+	rr.pos = newPos
+	return newPos, nil
+}
+
+func (rr *remoteRangeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= rr.size {
+		return 0, io.EOF
+	}
+	if off+int64(len(p)) > rr.size {
+		p = p[:rr.size-off]
+	}
+
+	var read int
+	for read < len(p) {
+		cur := off + int64(read)
+		idx := cur / rr.chunkSize
+		chunkStart := idx * rr.chunkSize
+
+		data, err := rr.chunk(idx, chunkStart)
+		if err != nil {
+			return read, err
+		}
+
+		inChunk := cur - chunkStart
+		n := copy(p[read:], data[inChunk:])
+		read += n
+	}
+
+	rr.prefetchAhead(off / rr.chunkSize)
+
+	var err error
+	if off+int64(read) >= rr.size {
+		err = io.EOF
+	}
+	return read, err
+}
+
+// chunk returns the bytes of chunk idx (offset chunkStart from rr.base),
+// clamped to rr.size, fetching and caching it on a miss.
+func (rr *remoteRangeReader) chunk(idx, chunkStart int64) ([]byte, error) {
+	key := cacheKey(rr.url, rr.base, rr.size, idx)
+
+	if p, ok := rr.cache.get(key); ok {
+		data, err := os.ReadFile(p)
+		if err == nil {
+			return data, nil
+		}
+		// Fall through and re-fetch; the cached file may have been evicted
+		// out from under us between get() and ReadFile.
+	}
+
+	length := rr.chunkSize
+	if rr.base+chunkStart+length > rr.base+rr.size {
+		length = rr.size - chunkStart
+	}
+
+	body, err := rr.transport.RangeRead(rr.ctx, rr.url, rr.base+chunkStart, length)
+	if err != nil {
+		return nil, xerrors.Errorf("fetching chunk %d of %s: %w", idx, rr.url, err)
+	}
+	defer body.Close() // nolint
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, xerrors.Errorf("reading chunk %d of %s: %w", idx, rr.url, err)
+	}
+
+	if _, err := rr.cache.put(key, data); err != nil {
+		log.Warnf("caching chunk %d of %s: %+v", idx, rr.url, err)
+	}
+
+	return data, nil
+}
+
+// prefetchAhead spawns background fetches of the chunks following afterIdx,
+// anticipating a sequential read. Each chunk is only ever prefetched once
+// per reader.
+func (rr *remoteRangeReader) prefetchAhead(afterIdx int64) {
+	lastIdx := (rr.size - 1) / rr.chunkSize
+
+	for i := int64(1); i <= int64(rr.prefetchN); i++ {
+		idx := afterIdx + i
+		if idx > lastIdx {
+			break
+		}
+
+		rr.prefetchMu.Lock()
+		if rr.prefetched[idx] {
+			rr.prefetchMu.Unlock()
+			continue
+		}
+		rr.prefetched[idx] = true
+		rr.prefetchMu.Unlock()
+
+		if _, ok := rr.cache.get(cacheKey(rr.url, rr.base, rr.size, idx)); ok {
+			continue
+		}
+
+		idx := idx
+		go func() {
+			if _, err := rr.chunk(idx, idx*rr.chunkSize); err != nil {
+				log.Debugf("prefetching chunk %d of %s: %+v", idx, rr.url, err)
+			}
+		}()
+	}
+}
+
+func (rr *remoteRangeReader) Close() error {
+	rr.cancel()
+	return nil
+}
+
+var _ io.ReadCloser = &remoteRangeReader{}
+var _ io.ReaderAt = &remoteRangeReader{}
+var _ io.Seeker = &remoteRangeReader{}
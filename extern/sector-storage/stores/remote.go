@@ -2,12 +2,10 @@ package stores
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math/bits"
-	"mime"
 	"net/http"
 	"net/url"
 	"os"
@@ -15,11 +13,11 @@ import (
 	"path/filepath"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/filecoin-project/lotus/extern/sector-storage/fsutil"
 	"github.com/filecoin-project/lotus/extern/sector-storage/partialfile"
 	"github.com/filecoin-project/lotus/extern/sector-storage/storiface"
-	"github.com/filecoin-project/lotus/extern/sector-storage/tarutil"
 
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/specs-storage/storage"
@@ -41,6 +39,11 @@ type Remote struct {
 
 	fetchLk  sync.Mutex
 	fetching map[abi.SectorID]chan struct{}
+
+	fetchCfg   *FetchConfig
+	sources    *sourceScheduler
+	transports *TransportRegistry
+	rangeCache *rangeCache
 }
 
 func (r *Remote) RemoveCopies(ctx context.Context, s abi.SectorID, types storiface.SectorFileType) error {
@@ -51,7 +54,35 @@ func (r *Remote) RemoveCopies(ctx context.Context, s abi.SectorID, types storifa
 	return r.local.RemoveCopies(ctx, s, types)
 }
 
-func NewRemote(local *Local, index SectorIndex, auth http.Header, fetchLimit int) *Remote {
+// NewRemote creates a Remote which fetches sector files from the URLs it
+// gets from index, using transports to decide how to speak to each URL's
+// scheme. fetchCfg controls the resumable/parallel ranged fetch path (see
+// FetchConfig); pass nil to get DefaultFetchConfig(). transports controls
+// which SectorTransport handles which URL scheme; pass nil to get
+// DefaultTransportRegistry(auth), which is all plain HTTP(S) sector storage
+// ever needed.
+func NewRemote(local *Local, index SectorIndex, auth http.Header, fetchLimit int, fetchCfg *FetchConfig, transports *TransportRegistry) *Remote {
+	if fetchCfg == nil {
+		fetchCfg = DefaultFetchConfig()
+	}
+	if transports == nil {
+		transports = DefaultTransportRegistry(auth)
+	}
+
+	cacheDir := fetchCfg.CacheDir
+	if cacheDir == "" {
+		cacheDir = filepath.Join(os.TempDir(), FetchTempSubdir, "range-cache")
+	}
+	rc, err := newRangeCache(cacheDir, fetchCfg.CacheBudgetBytes, fetchCfg.CacheMinFreeBytes)
+	if err != nil {
+		// Reader()'s range cache is an optimization, not a correctness
+		// requirement - fall back to an empty, permanently-caching-nothing
+		// cache (every chunk() call will just be a cache miss) rather than
+		// failing Remote construction over a temp dir we couldn't create.
+		log.Warnf("creating remote range cache at %s: %+v; reads will bypass the cache", cacheDir, err)
+		rc = &rangeCache{dir: cacheDir, budget: fetchCfg.CacheBudgetBytes, minFree: fetchCfg.CacheMinFreeBytes, sizes: map[string]int64{}}
+	}
+
 	return &Remote{
 		local: local,
 		index: index,
@@ -60,6 +91,11 @@ func NewRemote(local *Local, index SectorIndex, auth http.Header, fetchLimit int
 		limit: make(chan struct{}, fetchLimit),
 
 		fetching: map[abi.SectorID]chan struct{}{},
+
+		fetchCfg:   fetchCfg,
+		sources:    newSourceScheduler(),
+		transports: transports,
+		rangeCache: rc,
 	}
 }
 
@@ -174,6 +210,13 @@ func tempFetchDest(spath string, create bool) (string, error) {
 	return filepath.Join(tempdir, b), nil
 }
 
+// fetchCandidate is one (storage, URL) pair acquireFromRemote may try to
+// fetch a sector file from.
+type fetchCandidate struct {
+	url       string
+	storageID ID
+}
+
 func (r *Remote) acquireFromRemote(ctx context.Context, s abi.SectorID, fileType storiface.SectorFileType, dest string) (string, error) {
 	si, err := r.index.StorageFindSector(ctx, s, fileType, 0, false)
 	if err != nil {
@@ -188,141 +231,166 @@ func (r *Remote) acquireFromRemote(ctx context.Context, s abi.SectorID, fileType
 		return si[i].Weight < si[j].Weight
 	})
 
-	var merr error
+	// TODO: see what we have local, prefer that
+
+	var candidates []fetchCandidate
 	for _, info := range si {
-		// TODO: see what we have local, prefer that
+		for _, url := range r.sources.order(info.URLs) {
+			candidates = append(candidates, fetchCandidate{url: url, storageID: info.ID})
+		}
+	}
 
-		for _, url := range info.URLs {
-			tempDest, err := tempFetchDest(dest, true)
-			if err != nil {
-				return "", err
-			}
+	raceWidth := r.fetchCfg.RaceWidth
+	if raceWidth < 1 {
+		raceWidth = 1
+	}
 
-			if err := os.RemoveAll(dest); err != nil {
-				return "", xerrors.Errorf("removing dest: %w", err)
-			}
+	var merr error
+	for start := 0; start < len(candidates); start += raceWidth {
+		end := start + raceWidth
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		wave := candidates[start:end]
 
-			err = r.fetch(ctx, url, tempDest)
-			if err != nil {
-				merr = multierror.Append(merr, xerrors.Errorf("fetch error %s (storage %s) -> %s: %w", url, info.ID, tempDest, err))
-				continue
-			}
+		tempDest, err := tempFetchDest(dest, true)
+		if err != nil {
+			return "", err
+		}
 
-			if err := move(tempDest, dest); err != nil {
-				return "", xerrors.Errorf("fetch move error (storage %s) %s -> %s: %w", info.ID, tempDest, dest, err)
-			}
+		if err := os.RemoveAll(dest); err != nil {
+			return "", xerrors.Errorf("removing dest: %w", err)
+		}
 
-			if merr != nil {
-				log.Warnw("acquireFromRemote encountered errors when fetching sector from remote", "errors", merr)
-			}
-			return url, nil
+		winner, err := r.raceFetch(ctx, wave, tempDest)
+		if err != nil {
+			merr = multierror.Append(merr, err)
+			continue
+		}
+
+		if err := move(tempDest, dest); err != nil {
+			return "", xerrors.Errorf("fetch move error (storage %s) %s -> %s: %w", winner.storageID, tempDest, dest, err)
 		}
+
+		if merr != nil {
+			log.Warnw("acquireFromRemote encountered errors when fetching sector from remote", "errors", merr)
+		}
+		return winner.url, nil
 	}
 
 	return "", xerrors.Errorf("failed to acquire sector %v from remote (tried %v): %w", s, si, merr)
 }
 
-func (r *Remote) fetch(ctx context.Context, url, outname string) error {
-	log.Infof("Fetch %s -> %s", url, outname)
+// raceFetch fetches from up to len(candidates) sources concurrently, each
+// into its own temp file under tempDest's directory, and keeps the first one
+// to succeed - renaming its temp file to tempDest and discarding the rest.
+// Every completed fetch and every failure other than context cancellation
+// is recorded against that source's sourceScheduler stats so future calls
+// prefer faster/healthier sources; a racer cancelled after losing is not.
+func (r *Remote) raceFetch(ctx context.Context, candidates []fetchCandidate, tempDest string) (fetchCandidate, error) {
+	raceCtx, cancel := context.WithCancel(ctx)
 
-	if len(r.limit) >= cap(r.limit) {
-		log.Infof("Throttling fetch, %d already running", len(r.limit))
+	type raceResult struct {
+		c    fetchCandidate
+		dest string
+		err  error
 	}
 
-	// TODO: Smarter throttling
-	//  * Priority (just going sequentially is still pretty good)
-	//  * Per interface
-	//  * Aware of remote load
-	select {
-	case r.limit <- struct{}{}:
-		defer func() { <-r.limit }()
-	case <-ctx.Done():
-		return xerrors.Errorf("context error while waiting for fetch limiter: %w", ctx.Err())
-	}
+	results := make(chan raceResult, len(candidates))
+	for i, c := range candidates {
+		go func(i int, c fetchCandidate) {
+			dest := fmt.Sprintf("%s.race%d", tempDest, i)
+			start := time.Now()
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return xerrors.Errorf("request: %w", err)
-	}
-	req.Header = r.auth
-	req = req.WithContext(ctx)
+			err := r.fetch(raceCtx, c.url, dest)
+			if err != nil {
+				// A losing racer gets its fetch cancelled via raceCtx once
+				// another candidate wins - that's not this source being
+				// unhealthy, just losing on timing, so it shouldn't degrade
+				// the EWMA score sourceScheduler uses to prefer it next time.
+				if !errors.Is(err, context.Canceled) {
+					r.sources.recordFailure(c.url)
+				}
+			} else if fi, statErr := os.Stat(dest); statErr == nil {
+				r.sources.recordSuccess(c.url, time.Since(start), fi.Size())
+			}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return xerrors.Errorf("do request: %w", err)
+			results <- raceResult{c: c, dest: dest, err: err}
+		}(i, c)
 	}
-	defer resp.Body.Close() // nolint
 
-	if resp.StatusCode != 200 {
-		return xerrors.Errorf("non-200 code: %d", resp.StatusCode)
+	var merr error
+	var winner *raceResult
+	remaining := len(candidates)
+
+	for remaining > 0 && winner == nil {
+		res := <-results
+		remaining--
+		if res.err != nil {
+			if err := os.RemoveAll(res.dest); err != nil {
+				log.Warnf("removing failed race fetch temp file %s: %+v", res.dest, err)
+			}
+			merr = multierror.Append(merr, xerrors.Errorf("fetch error %s (storage %s) -> %s: %w", res.c.url, res.c.storageID, res.dest, res.err))
+			continue
+		}
+		res := res
+		winner = &res
 	}
 
-	/*bar := pb.New64(w.sizeForType(typ))
-	bar.ShowPercent = true
-	bar.ShowSpeed = true
-	bar.Units = pb.U_BYTES
-
-	barreader := bar.NewProxyReader(resp.Body)
+	cancel() // stop any racers still in flight now that we have a winner (or everyone's failed)
 
-	bar.Start()
-	defer bar.Finish()*/
-
-	mediatype, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
-	if err != nil {
-		return xerrors.Errorf("parse media type: %w", err)
+	if remaining > 0 {
+		go func(remaining int) {
+			for i := 0; i < remaining; i++ {
+				res := <-results
+				if err := os.RemoveAll(res.dest); err != nil {
+					log.Warnf("removing losing race fetch temp file %s: %+v", res.dest, err)
+				}
+			}
+		}(remaining)
 	}
 
-	if err := os.RemoveAll(outname); err != nil {
-		return xerrors.Errorf("removing dest: %w", err)
+	if winner == nil {
+		return fetchCandidate{}, merr
 	}
 
-	switch mediatype {
-	case "application/x-tar":
-		return tarutil.ExtractTar(resp.Body, outname)
-	case "application/octet-stream":
-		f, err := os.Create(outname)
-		if err != nil {
-			return err
-		}
-		_, err = io.CopyBuffer(f, resp.Body, make([]byte, CopyBuf))
-		if err != nil {
-			f.Close() // nolint
-			return err
-		}
-		return f.Close()
-	default:
-		return xerrors.Errorf("unknown content type: '%s'", mediatype)
+	if err := os.Rename(winner.dest, tempDest); err != nil {
+		return fetchCandidate{}, xerrors.Errorf("renaming race winner %s -> %s: %w", winner.dest, tempDest, err)
 	}
+
+	return winner.c, nil
 }
 
-func (r *Remote) checkAllocated(ctx context.Context, url string, spt abi.RegisteredSealProof, offset, size abi.PaddedPieceSize) (bool, error) {
-	url = fmt.Sprintf("%s/%d/allocated/%d/%d", url, spt, offset.Unpadded(), size.Unpadded())
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return false, xerrors.Errorf("request: %w", err)
-	}
-	req.Header = r.auth.Clone()
-	req = req.WithContext(ctx)
+// fetch downloads url into outname via the SectorTransport registered for
+// url's scheme. Sector files are large enough (and transient network
+// failures common enough, over the kind of links that connect a miner to
+// its workers) that a plain whole-file Fetch is wasteful to restart from
+// zero on failure, so for the default httpTransport - when it advertises
+// Accept-Ranges on an octet-stream response (i.e. not a tar-packed
+// multi-file response, which has to be streamed through tarutil
+// sequentially) - fetch splits the transfer into r.fetchCfg.Parallelism
+// concurrent ranged GETs and resumes from a .part sidecar if one is left
+// over from an earlier attempt. Other transports don't get that fast path
+// yet and just run their plain Fetch.
+func (r *Remote) fetch(ctx context.Context, url, outname string) error {
+	log.Infof("Fetch %s -> %s", url, outname)
 
-	resp, err := http.DefaultClient.Do(req)
+	transport, err := r.transports.forURL(url)
 	if err != nil {
-		return false, xerrors.Errorf("do request: %w", err)
+		return err
 	}
-	defer resp.Body.Close() // nolint
 
-	switch resp.StatusCode {
-	case http.StatusOK:
-		return true, nil
-	case http.StatusRequestedRangeNotSatisfiable:
-		return false, nil
-	default:
-		return false, xerrors.Errorf("unexpected http response: %d", resp.StatusCode)
+	if ht, ok := transport.(*httpTransport); ok {
+		probe, err := ht.Head(ctx, url)
+		if err != nil {
+			log.Warnf("probing %s failed, falling back to sequential fetch: %+v", url, err)
+		} else if probe.AcceptsRanges && probe.Mediatype == "application/octet-stream" && probe.Size > r.fetchCfg.ChunkSize {
+			return r.fetchRanged(ctx, ht, url, outname, probe)
+		}
 	}
-}
 
-func (r *Remote) readRemote(ctx context.Context, url string, spt abi.RegisteredSealProof, offset, size abi.PaddedPieceSize) (io.ReadCloser, error) {
 	if len(r.limit) >= cap(r.limit) {
-		log.Infof("Throttling remote read, %d already running", len(r.limit))
+		log.Infof("Throttling fetch, %d already running", len(r.limit))
 	}
 
 	// TODO: Smarter throttling
@@ -333,28 +401,35 @@ func (r *Remote) readRemote(ctx context.Context, url string, spt abi.RegisteredS
 	case r.limit <- struct{}{}:
 		defer func() { <-r.limit }()
 	case <-ctx.Done():
-		return nil, xerrors.Errorf("context error while waiting for fetch limiter: %w", ctx.Err())
+		return xerrors.Errorf("context error while waiting for fetch limiter: %w", ctx.Err())
 	}
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, xerrors.Errorf("request: %w", err)
-	}
-	req.Header = r.auth.Clone()
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
-	req = req.WithContext(ctx)
+	return transport.Fetch(ctx, url, outname)
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// checkAllocated asks whether the storage endpoint at url has the requested
+// unsealed piece range allocated, via the SectorTransport registered for
+// url's scheme (see httpTransport.CheckAllocated).
+func (r *Remote) checkAllocated(ctx context.Context, url string, spt abi.RegisteredSealProof, offset, size abi.PaddedPieceSize) (bool, error) {
+	transport, err := r.transports.forURL(url)
 	if err != nil {
-		return nil, xerrors.Errorf("do request: %w", err)
+		return false, err
 	}
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
-		resp.Body.Close() // nolint
-		return nil, xerrors.Errorf("non-200 code: %d", resp.StatusCode)
+	return transport.CheckAllocated(ctx, url, spt, offset, size)
+}
+
+// readRemote returns a cache-backed, seekable reader over [offset, offset+size)
+// of url, so a caller that seeks around within a piece (or re-reads bytes it
+// has already seen) doesn't re-fetch them from the network - see
+// remoteRangeReader and rangeCache.
+func (r *Remote) readRemote(ctx context.Context, url string, spt abi.RegisteredSealProof, offset, size abi.PaddedPieceSize) (io.ReadCloser, error) {
+	transport, err := r.transports.forURL(url)
+	if err != nil {
+		return nil, err
 	}
 
-	return resp.Body, nil
+	return newRemoteRangeReader(ctx, transport, url, int64(offset), int64(size), r.rangeCache, r.fetchCfg.CacheChunkSize, r.fetchCfg.PrefetchChunks), nil
 }
 
 func (r *Remote) CheckAllocated(ctx context.Context, s storage.SectorRef, offset, size abi.PaddedPieceSize, ft storiface.SectorFileType) (bool, error) {
@@ -538,24 +613,12 @@ func (r *Remote) Remove(ctx context.Context, sid abi.SectorID, typ storiface.Sec
 func (r *Remote) deleteFromRemote(ctx context.Context, url string) error {
 	log.Infof("Delete %s", url)
 
-	req, err := http.NewRequest("DELETE", url, nil)
+	transport, err := r.transports.forURL(url)
 	if err != nil {
-		return xerrors.Errorf("request: %w", err)
+		return err
 	}
-	req.Header = r.auth
-	req = req.WithContext(ctx)
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return xerrors.Errorf("do request: %w", err)
-	}
-	defer resp.Body.Close() // nolint
-
-	if resp.StatusCode != 200 {
-		return xerrors.Errorf("non-200 code: %d", resp.StatusCode)
-	}
-
-	return nil
+	return transport.Delete(ctx, url)
 }
 
 func (r *Remote) FsStat(ctx context.Context, id ID) (fsutil.FsStat, error) {
@@ -585,39 +648,12 @@ func (r *Remote) FsStat(ctx context.Context, id ID) (fsutil.FsStat, error) {
 
 	rl.Path = gopath.Join(rl.Path, "stat", string(id))
 
-	req, err := http.NewRequest("GET", rl.String(), nil)
+	transport, err := r.transports.forURL(rl.String())
 	if err != nil {
-		return fsutil.FsStat{}, xerrors.Errorf("request: %w", err)
+		return fsutil.FsStat{}, err
 	}
-	req.Header = r.auth
-	req = req.WithContext(ctx)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fsutil.FsStat{}, xerrors.Errorf("do request: %w", err)
-	}
-	switch resp.StatusCode {
-	case 200:
-		break
-	case 404:
-		return fsutil.FsStat{}, errPathNotFound
-	case 500:
-		b, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return fsutil.FsStat{}, xerrors.Errorf("fsstat: got http 500, then failed to read the error: %w", err)
-		}
-
-		return fsutil.FsStat{}, xerrors.Errorf("fsstat: got http 500: %s", string(b))
-	}
-
-	var out fsutil.FsStat
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		return fsutil.FsStat{}, xerrors.Errorf("decoding fsstat: %w", err)
-	}
-
-	defer resp.Body.Close() // nolint
 
-	return out, nil
+	return transport.Stat(ctx, rl.String())
 }
 
 var _ Store = &Remote{}
@@ -0,0 +1,160 @@
+package stores
+
+import (
+	"sync"
+	"time"
+)
+
+// sourceStatsDecay is the weight given to the newest sample when updating an
+// EWMA; higher reacts faster to a source going bad (or recovering) at the
+// cost of more noise from one-off blips.
+const sourceStatsDecay = 0.3
+
+// SourceStats is a point-in-time snapshot of what Remote has observed about
+// fetching from a given URL, returned by Remote.SourceStats() for
+// operational visibility (e.g. a metrics scrape or `lotus-miner sealing
+// jobs` style inspection command).
+type SourceStats struct {
+	LatencySeconds float64
+	ThroughputBps  float64
+	ErrorRate      float64
+	Samples        int
+}
+
+type sourceStats struct {
+	latencyEWMA    float64 // seconds per completed fetch
+	throughputEWMA float64 // bytes/sec
+	errorEWMA      float64 // 0..1 fraction of attempts that failed
+	samples        int
+}
+
+// sourceScheduler tracks lightweight health stats per source URL and uses
+// them to order candidate URLs so acquireFromRemote tries the
+// fastest/most-reliable source first instead of whatever order the index
+// happened to return. It does not know anything about sector storage; it
+// would work identically for any set of string identifiers.
+type sourceScheduler struct {
+	mu    sync.Mutex
+	stats map[string]*sourceStats
+}
+
+func newSourceScheduler() *sourceScheduler {
+	return &sourceScheduler{
+		stats: map[string]*sourceStats{},
+	}
+}
+
+func (ss *sourceScheduler) get(url string) *sourceStats {
+	st, ok := ss.stats[url]
+	if !ok {
+		st = &sourceStats{}
+		ss.stats[url] = st
+	}
+	return st
+}
+
+// recordSuccess updates url's latency/throughput/error EWMAs after a fetch
+// that transferred bytes in dur.
+func (ss *sourceScheduler) recordSuccess(url string, dur time.Duration, bytes int64) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	st := ss.get(url)
+	latency := dur.Seconds()
+	throughput := float64(bytes) / latency
+	if latency <= 0 {
+		throughput = 0
+	}
+
+	if st.samples == 0 {
+		st.latencyEWMA = latency
+		st.throughputEWMA = throughput
+		st.errorEWMA = 0
+	} else {
+		st.latencyEWMA = ewma(st.latencyEWMA, latency)
+		st.throughputEWMA = ewma(st.throughputEWMA, throughput)
+		st.errorEWMA = ewma(st.errorEWMA, 0)
+	}
+	st.samples++
+}
+
+// recordFailure marks an attempt against url as failed, decaying its
+// reliability without touching the latency/throughput estimate (a timeout
+// doesn't tell us much about how fast the source is when it does work).
+func (ss *sourceScheduler) recordFailure(url string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	st := ss.get(url)
+	if st.samples == 0 {
+		st.errorEWMA = 1
+	} else {
+		st.errorEWMA = ewma(st.errorEWMA, 1)
+	}
+	st.samples++
+}
+
+func ewma(old, sample float64) float64 {
+	return sourceStatsDecay*sample + (1-sourceStatsDecay)*old
+}
+
+// score returns a lower-is-better figure of merit for url: unseen URLs score
+// 0 so every source gets tried at least once before the scheduler starts
+// leaning on its history, and seen URLs are penalized by latency and more
+// heavily by error rate.
+func (ss *sourceScheduler) score(url string) float64 {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	st, ok := ss.stats[url]
+	if !ok || st.samples == 0 {
+		return 0
+	}
+	return st.latencyEWMA * (1 + 5*st.errorEWMA)
+}
+
+// order returns a copy of urls sorted by ascending score (best source
+// first). The sort is stable so that among equally-scored (e.g. all unseen)
+// URLs the index's original preference is kept.
+func (ss *sourceScheduler) order(urls []string) []string {
+	out := make([]string, len(urls))
+	copy(out, urls)
+
+	sortStableByScore(out, ss.score)
+	return out
+}
+
+// Stats returns a snapshot of every source sourceScheduler has seen an
+// attempt against.
+func (ss *sourceScheduler) Stats() map[string]SourceStats {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	out := make(map[string]SourceStats, len(ss.stats))
+	for url, st := range ss.stats {
+		out[url] = SourceStats{
+			LatencySeconds: st.latencyEWMA,
+			ThroughputBps:  st.throughputEWMA,
+			ErrorRate:      st.errorEWMA,
+			Samples:        st.samples,
+		}
+	}
+	return out
+}
+
+// sortStableByScore insertion-sorts urls by score(url); the slice is tiny
+// (a handful of storage URLs per sector) so this avoids pulling in sort.Slice
+// plus a closure allocation for what's effectively always a few elements.
+func sortStableByScore(urls []string, score func(string) float64) {
+	for i := 1; i < len(urls); i++ {
+		for j := i; j > 0 && score(urls[j]) < score(urls[j-1]); j-- {
+			urls[j], urls[j-1] = urls[j-1], urls[j]
+		}
+	}
+}
+
+// SourceStats returns the current health stats Remote has observed for
+// every source URL it has attempted a fetch against.
+func (r *Remote) SourceStats() map[string]SourceStats {
+	return r.sources.Stats()
+}
@@ -0,0 +1,189 @@
+package sectorstorage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/lotus/extern/sector-storage/storiface"
+)
+
+// TaskEventKind classifies a TaskEvent.
+type TaskEventKind string
+
+const (
+	TaskStart        TaskEventKind = "start"
+	TaskProgress     TaskEventKind = "progress"
+	TaskDone         TaskEventKind = "done"
+	TaskFailed       TaskEventKind = "failed"
+	ResourceReserved TaskEventKind = "resource-reserved"
+	ResourceReleased TaskEventKind = "resource-released"
+)
+
+// TaskEvent is one entry in a LocalWorker's task lifecycle stream. Not every
+// field is populated for every Kind: Stage/Fraction are only meaningful for
+// TaskProgress, and Err only for TaskFailed.
+type TaskEvent struct {
+	Kind    TaskEventKind
+	Time    time.Time
+	CallID  storiface.CallID
+	Sector  abi.SectorID
+	RetType ReturnType
+
+	// Stage/Fraction describe a TaskProgress milestone - e.g. ("layers",
+	// 0.4) partway through PC1, or ("tree-r", 1.0) once PC2's last tree is
+	// built. Producers that can't report finer-grained progress than
+	// start/done (most of them, today - see ProgressFromContext) simply
+	// never emit TaskProgress.
+	Stage    string
+	Fraction float64
+
+	Err string
+}
+
+// eventRingSize bounds how much history a late Subscribe call can replay.
+// It's sized for "a new monitoring tool just attached and wants to know
+// what's running right now", not as a durable event log.
+const eventRingSize = 256
+
+// eventBus fans TaskEvents out to every current subscriber and keeps a
+// rolling history so a subscriber that attaches mid-task still sees its
+// TaskStart.
+type eventBus struct {
+	mu     sync.Mutex
+	ring   []TaskEvent
+	subs   map[int]chan TaskEvent
+	nextID int
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: map[int]chan TaskEvent{}}
+}
+
+func (b *eventBus) publish(ev TaskEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.ring = append(b.ring, ev)
+	if len(b.ring) > eventRingSize {
+		b.ring = b.ring[len(b.ring)-eventRingSize:]
+	}
+
+	for _, ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			// A slow subscriber drops events rather than blocking sealing
+			// work or other subscribers; it can always read the ring again
+			// by resubscribing.
+			log.Warnf("TaskEvent subscriber channel full, dropping event %+v", ev)
+		}
+	}
+}
+
+// subscribe registers ch, first replaying the current ring buffer into it.
+// Replay happens under the bus lock so no event published after subscribe
+// is called can be missed or duplicated across the replay/live boundary.
+func (b *eventBus) subscribe(ch chan TaskEvent) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, ev := range b.ring {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = ch
+	return id
+}
+
+func (b *eventBus) unsubscribe(id int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch, ok := b.subs[id]; ok {
+		delete(b.subs, id)
+		close(ch)
+	}
+}
+
+// Subscribe returns a channel of TaskEvents - TaskStart/TaskProgress/
+// TaskDone/TaskFailed for every asyncCall, plus ResourceReserved/Released
+// around VRAM claims - backed first by eventRingSize events of recent
+// history, then live. The channel is closed when ctx is done; callers must
+// keep draining it (or cancel ctx) rather than let it fill, since a full
+// channel causes this worker to drop events for that subscriber instead of
+// blocking sealing work.
+func (l *LocalWorker) Subscribe(ctx context.Context) <-chan TaskEvent {
+	ch := make(chan TaskEvent, eventRingSize)
+	id := l.events.subscribe(ch)
+
+	go func() {
+		<-ctx.Done()
+		l.events.unsubscribe(id)
+	}()
+
+	return ch
+}
+
+func (l *LocalWorker) emitStart(ci storiface.CallID, rt ReturnType) {
+	l.events.publish(TaskEvent{Kind: TaskStart, Time: time.Now(), CallID: ci, Sector: ci.Sector, RetType: rt})
+}
+
+func (l *LocalWorker) emitProgress(ci storiface.CallID, rt ReturnType, stage string, fraction float64) {
+	l.events.publish(TaskEvent{Kind: TaskProgress, Time: time.Now(), CallID: ci, Sector: ci.Sector, RetType: rt, Stage: stage, Fraction: fraction})
+}
+
+func (l *LocalWorker) emitDone(ci storiface.CallID, rt ReturnType) {
+	l.events.publish(TaskEvent{Kind: TaskDone, Time: time.Now(), CallID: ci, Sector: ci.Sector, RetType: rt})
+}
+
+func (l *LocalWorker) emitFailed(ci storiface.CallID, rt ReturnType, err error) {
+	l.events.publish(TaskEvent{Kind: TaskFailed, Time: time.Now(), CallID: ci, Sector: ci.Sector, RetType: rt, Err: err.Error()})
+}
+
+func (l *LocalWorker) emitResourceReserved(ci storiface.CallID, rt ReturnType) {
+	l.events.publish(TaskEvent{Kind: ResourceReserved, Time: time.Now(), CallID: ci, Sector: ci.Sector, RetType: rt})
+}
+
+func (l *LocalWorker) emitResourceReleased(ci storiface.CallID, rt ReturnType) {
+	l.events.publish(TaskEvent{Kind: ResourceReleased, Time: time.Now(), CallID: ci, Sector: ci.Sector, RetType: rt})
+}
+
+// progressCtxKey is how a progress reporter rides along on the context
+// asyncCallWithID hands to work(), so the long FFI calls it wraps (PC1's
+// layers, PC2's tree build, C2's SNARK rounds) can push milestones back
+// without plumbing an extra parameter through every call site.
+type progressCtxKey struct{}
+
+// ProgressFunc reports a named stage reaching some fraction of completion
+// (0 to 1).
+type ProgressFunc func(stage string, fraction float64)
+
+// withProgress attaches a ProgressFunc to ctx for progress-aware callees
+// to find via ProgressFromContext.
+func withProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressCtxKey{}, fn)
+}
+
+// ProgressFromContext recovers the ProgressFunc asyncCallWithID attached to
+// a task's context, if any.
+//
+// ffiwrapper.Storage (the real sb.SealPreCommit1/SealPreCommit2/SealCommit2
+// implementation) lives outside this checkout, so its PC1/PC2/C2 internals
+// can't actually be changed here to call this - wiring it up for real means
+// adding a call to ProgressFromContext(ctx) at ffiwrapper's layer-loop / tree
+// building / SNARK round boundaries once that package's interface is
+// extended to accept (or read from ctx) a progress reporter. Until then,
+// asyncCallWithID only has start/done/failed granularity to report, which
+// is what it emits.
+func ProgressFromContext(ctx context.Context) (ProgressFunc, bool) {
+	fn, ok := ctx.Value(progressCtxKey{}).(ProgressFunc)
+	return fn, ok
+}
@@ -4,9 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"io"
-	"io/ioutil"
 	"os"
-	"path"
 	"reflect"
 	"sync"
 	"sync/atomic"
@@ -38,24 +36,46 @@ type WorkerConfig struct {
 	// worker regardless of its currently available resources. Used in testing
 	// with the local worker.
 	IgnoreResourceFiltering bool
+
+	// ResourceOverrides lets an operator pin or override any subset of the
+	// resources LocalWorker would otherwise autodetect (see probeResources
+	// in worker_resources.go) - useful when autodetection is wrong (e.g. a
+	// cgroup memory limit it can't see) or when VRAM is shared with
+	// something outside lotus's view. Zero-valued fields are left to
+	// autodetection.
+	ResourceOverrides storiface.WorkerResources
+
+	// TaskGateConcurrency overrides how many sectors may run a given task
+	// concurrently (default 1, matching the single p1Mutex/p2Mutex/c2Mutex
+	// this used to serialize SealPreCommit1/SealPreCommit2/SealCommit2
+	// with). Set a TaskType's entry above 1 for hardware that can actually
+	// run more than one at once - e.g. multiple PC1s on a machine with
+	// enough spare RAM/CPU.
+	TaskGateConcurrency map[sealtasks.TaskType]int
+
+	// TaskGatePolicy selects the TaskGate ordering policy (see GatePolicy)
+	// for a given TaskType; unset entries default to FIFOPolicy.
+	TaskGatePolicy map[sealtasks.TaskType]GatePolicy
 }
 
 // used do provide custom proofs impl (mostly used in testing)
 type ExecutorFunc func() (ffiwrapper.Storage, error)
 
 type LocalWorkerExtParams struct {
-	PieceTemplateSize abi.SectorSize
-	PieceTemplateDir  string
-	MerkleTreecache   string
+	// PieceTemplateDir roots a PieceTemplateStore: each subdirectory is one
+	// registered template (staged-file + piece-info.json), rather than the
+	// single staged-file/piece-info.json pair it held before templates were
+	// keyed by (sector size, piece size, piece CID).
+	PieceTemplateDir string
+	MerkleTreecache  string
 
 	GroupID string
 	Role    string
 }
 
 type LocalWorker struct {
-	pieceTemplateSize abi.SectorSize
-	pieceTemplateDir  string
-	merkleTreecache   string
+	pieceTemplates  *PieceTemplateStore
+	merkleTreecache string
 
 	groupID string
 
@@ -84,9 +104,28 @@ type LocalWorker struct {
 		uint64
 	}
 
-	p1Mutex sync.Mutex
-	p2Mutex sync.Mutex
-	c2Mutex sync.Mutex
+	p1Gate TaskGate
+	p2Gate TaskGate
+	c2Gate TaskGate
+
+	// gateConcurrency mirrors the capacity p1Gate/p2Gate/c2Gate were built
+	// with (see gateConcurrency in worker_taskgate.go), so
+	// HasResourceForNewTask's admission check agrees with what the gates
+	// themselves will actually let through instead of falling back to
+	// parallelConfig's hardcoded caps.
+	gateConcurrency map[sealtasks.TaskType]int
+
+	// resources is probed once at startup (see probeResources); CPU/GPU
+	// counts and the configured memory budget don't change at runtime, so
+	// Info returns this as probed, and ResourceStats refreshes only the live
+	// MemUsed/MemSwapUsed fields on top of it.
+	resources storiface.WorkerResources
+	vram      *gpuMemTracker
+
+	// events fans out TaskStart/TaskProgress/TaskDone/TaskFailed/
+	// ResourceReserved/ResourceReleased events for external observers (see
+	// Subscribe in worker_events.go).
+	events *eventBus
 }
 
 func newLocalWorker(executor ExecutorFunc, wcfg WorkerConfig,
@@ -121,13 +160,42 @@ func newLocalWorker(executor ExecutorFunc, wcfg WorkerConfig,
 			string
 			uint64
 		}, 16),
+
+		p1Gate: newTaskGate(string(sealtasks.TTPreCommit1), gatePolicy(wcfg, sealtasks.TTPreCommit1), gateConcurrency(wcfg, sealtasks.TTPreCommit1)),
+		p2Gate: newTaskGate(string(sealtasks.TTPreCommit2), gatePolicy(wcfg, sealtasks.TTPreCommit2), gateConcurrency(wcfg, sealtasks.TTPreCommit2)),
+		c2Gate: newTaskGate(string(sealtasks.TTCommit2), gatePolicy(wcfg, sealtasks.TTCommit2), gateConcurrency(wcfg, sealtasks.TTCommit2)),
+
+		gateConcurrency: map[sealtasks.TaskType]int{
+			sealtasks.TTPreCommit1: gateConcurrency(wcfg, sealtasks.TTPreCommit1),
+			sealtasks.TTPreCommit2: gateConcurrency(wcfg, sealtasks.TTPreCommit2),
+			sealtasks.TTCommit2:    gateConcurrency(wcfg, sealtasks.TTCommit2),
+		},
+
+		events: newEventBus(),
 	}
 
+	res, err := probeResources(wcfg.NoSwap, wcfg.ResourceOverrides)
+	if err != nil {
+		log.Errorf("probing worker resources, falling back to zero-value resources: %+v", err)
+	}
+	w.resources = res
+
+	numGPUs := len(res.GPUs)
+	perGPU := uint64(defaultGPUVRAMBytes)
+	w.vram = newGPUMemTracker(perGPU, numGPUs)
+
 	if ext != nil {
 		w.groupID = ext.GroupID
-		w.pieceTemplateDir = ext.PieceTemplateDir
-		w.pieceTemplateSize = ext.PieceTemplateSize
 		w.merkleTreecache = ext.MerkleTreecache
+
+		pts, err := NewPieceTemplateStore(ext.PieceTemplateDir)
+		if err != nil {
+			log.Errorf("loading piece templates from %s, continuing without any: %+v", ext.PieceTemplateDir, err)
+			pts = &PieceTemplateStore{}
+		}
+		w.pieceTemplates = pts
+	} else {
+		w.pieceTemplates = &PieceTemplateStore{}
 	}
 
 	if w.executor == nil {
@@ -142,9 +210,29 @@ func newLocalWorker(executor ExecutorFunc, wcfg WorkerConfig,
 
 	go func() {
 		for _, call := range unfinished {
-			err := storiface.Err(storiface.ErrTempWorkerRestart, xerrors.New("worker restarted"))
+			call := call
+
+			// Resumable ReturnTypes (see resumers) get re-dispatched under
+			// their original CallID instead of being aborted: the manager
+			// is already waiting on that ID, so as long as asyncCallWithID
+			// kicks the work back off successfully, nothing more needs to
+			// happen here - the manager keeps waiting exactly as it would
+			// for any other still-running call, and doReturn fires
+			// normally whenever the re-dispatched work finishes.
+			//
+			// Note: distinguishing "still resuming" from "abandoned" on the
+			// manager side (the requested ErrResuming state) belongs in the
+			// scheduler package, which isn't part of this worker.
+			if resume, ok := resumers[call.RetType]; ok && call.Resume != nil {
+				log.Infof("resuming %s call %s for sector %v after worker restart", call.RetType, call.ID, call.Sector)
+				if _, err := resume(w, call.ID, call.Sector, call.Resume); err == nil {
+					continue
+				} else {
+					log.Errorf("resuming %s call %s failed, giving up on it: %+v", call.RetType, call.ID, err)
+				}
+			}
 
-			// TODO: Handle restarting PC1 once support is merged
+			err := storiface.Err(storiface.ErrTempWorkerRestart, xerrors.New("worker restarted"))
 
 			if doReturn(context.TODO(), call.RetType, call.ID, ret, nil, err) {
 				if err := w.ct.onReturned(call.ID); err != nil {
@@ -327,29 +415,63 @@ var returnFunc = map[ReturnType]func(context.Context, storiface.CallID, storifac
 	Fetch:           rfunc(storiface.WorkerReturn.ReturnFetch),
 }
 
-func (l *LocalWorker) asyncCall(ctx context.Context, sector storage.SectorRef, rt ReturnType, work func(ctx context.Context, ci storiface.CallID) (interface{}, error)) (storiface.CallID, error) {
+// resumers maps a resumable ReturnType to a function that re-dispatches the
+// checkpointed call under its original CallID. ReturnTypes with no entry
+// here (AddPiece's io.Reader can't be replayed from a checkpoint; Fetch,
+// FinalizeSector, MoveStorage, UnsealPiece and ReleaseUnsealed aren't worth
+// the complexity) keep the old behavior of failing with
+// ErrTempWorkerRestart, so the manager reschedules them from scratch.
+var resumers = map[ReturnType]func(l *LocalWorker, ci storiface.CallID, sector storage.SectorRef, ra *resumeArgs) (storiface.CallID, error){
+	SealPreCommit1: func(l *LocalWorker, ci storiface.CallID, sector storage.SectorRef, ra *resumeArgs) (storiface.CallID, error) {
+		return l.resumeSealPreCommit1(ci, sector, ra)
+	},
+	SealPreCommit2: func(l *LocalWorker, ci storiface.CallID, sector storage.SectorRef, ra *resumeArgs) (storiface.CallID, error) {
+		return l.resumeSealPreCommit2(ci, sector, ra)
+	},
+	SealCommit1: func(l *LocalWorker, ci storiface.CallID, sector storage.SectorRef, ra *resumeArgs) (storiface.CallID, error) {
+		return l.resumeSealCommit1(ci, sector, ra)
+	},
+	SealCommit2: func(l *LocalWorker, ci storiface.CallID, sector storage.SectorRef, ra *resumeArgs) (storiface.CallID, error) {
+		return l.resumeSealCommit2(ci, sector, ra)
+	},
+}
+
+func (l *LocalWorker) asyncCall(ctx context.Context, sector storage.SectorRef, rt ReturnType, resume *resumeArgs, work func(ctx context.Context, ci storiface.CallID) (interface{}, error)) (storiface.CallID, error) {
 	ci := storiface.CallID{
 		Sector: sector.ID,
 		ID:     uuid.New(),
 	}
 
-	if err := l.ct.onStart(ci, rt); err != nil {
+	return l.asyncCallWithID(ctx, sector, ci, rt, resume, work)
+}
+
+// asyncCallWithID is asyncCall with a caller-supplied CallID; it's what lets
+// the restart path in newLocalWorker re-dispatch a checkpointed call under
+// the ID the manager is already waiting on, rather than start a second call
+// the manager has never heard of.
+func (l *LocalWorker) asyncCallWithID(ctx context.Context, sector storage.SectorRef, ci storiface.CallID, rt ReturnType, resume *resumeArgs, work func(ctx context.Context, ci storiface.CallID) (interface{}, error)) (storiface.CallID, error) {
+	if err := l.ct.onStart(ci, sector, rt, resume); err != nil {
 		log.Errorf("tracking call (start): %+v", err)
 	}
 
 	l.running.Add(1)
+	l.emitStart(ci, rt)
 
 	go func() {
 		defer l.running.Done()
 
 		ctx := &wctx{
-			vals:    ctx,
+			vals: withProgress(ctx, func(stage string, fraction float64) {
+				l.emitProgress(ci, rt, stage, fraction)
+			}),
 			closing: l.closing,
 		}
 
 		res, err := work(ctx, ci)
 
 		if err != nil {
+			l.emitFailed(ci, rt, err)
+
 			rb, err := json.Marshal(res)
 			if err != nil {
 				log.Errorf("tracking call (marshaling results): %+v", err)
@@ -358,6 +480,8 @@ func (l *LocalWorker) asyncCall(ctx context.Context, sector storage.SectorRef, r
 					log.Errorf("tracking call (done): %+v", err)
 				}
 			}
+		} else {
+			l.emitDone(ci, rt)
 		}
 
 		if doReturn(ctx, rt, ci, l.ret, res, toCallError(err)) {
@@ -419,43 +543,29 @@ func (l *LocalWorker) AddPiece(ctx context.Context, sector storage.SectorRef, ep
 	}
 
 	size, _ := sector.ProofType.SectorSize()
-	hasTemplate := l.hasPieceTemplate()
+	tmpl, hasTemplate := l.pieceTemplates.BestFit(size, sz, cid.Undef)
 
-	log.Debugf("AddPiece size: %d, hasTemplate: %v, pieceTemplateSize: %d", size, hasTemplate, l.pieceTemplateSize)
-	if hasTemplate && size <= l.pieceTemplateSize {
-		return l.asyncCall(ctx, sector, AddPiece, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
-			return l.loadPieceTemplate(ctx, sector)
+	log.Debugf("AddPiece size: %d, hasTemplate: %v", size, hasTemplate)
+	if hasTemplate {
+		return l.asyncCall(ctx, sector, AddPiece, nil, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
+			return l.loadPieceTemplate(ctx, sector, tmpl)
 		})
 	}
 
-	return l.asyncCall(ctx, sector, AddPiece, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
+	// AddPiece isn't resumable: r is an io.Reader the caller can't be asked
+	// to replay from the start after a worker restart, so it's always
+	// restarted from scratch like before (no entry in resumers).
+	return l.asyncCall(ctx, sector, AddPiece, nil, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
 		return sb.AddPiece(ctx, sector, epcs, sz, r)
 	})
 }
 
-func (l *LocalWorker) hasPieceTemplate() bool {
-	if l.pieceTemplateDir == "" {
-		return false
-	}
-
-	pieceFilePath := path.Join(l.pieceTemplateDir, "staged-file")
-	pieceinfos := path.Join(l.pieceTemplateDir, "piece-info.json")
-
-	_, err := os.Stat(pieceFilePath)
-	if os.IsNotExist(err) {
-		return false
-	}
-
-	_, err = os.Stat(pieceinfos)
-	if os.IsNotExist(err) {
-		return false
-	}
-
-	return true
-}
-
-func (l *LocalWorker) loadPieceTemplate(ctx context.Context, sector storage.SectorRef) (abi.PieceInfo, error) {
-	log.Debugf("loadPieceTemplate call, sector:%v", sector)
+// loadPieceTemplate stages tmpl's data as sector's unsealed piece,
+// reflinking (or, failing that, copying) it in so downstream sealing
+// stages can safely mutate the unsealed file - a symlink, which this used
+// when there was only ever one template, can't guarantee that.
+func (l *LocalWorker) loadPieceTemplate(ctx context.Context, sector storage.SectorRef, tmpl PieceTemplateInfo) (abi.PieceInfo, error) {
+	log.Debugf("loadPieceTemplate call, sector:%v, template:%s", sector, tmpl.PieceCID)
 
 	stagedPath, done, err := (&localWorkerPathProvider{w: l}).AcquireSector(ctx, sector, 0, storiface.FTUnsealed, storiface.PathSealing)
 	if err != nil {
@@ -469,36 +579,37 @@ func (l *LocalWorker) loadPieceTemplate(ctx context.Context, sector storage.Sect
 		}
 	}()
 
-	pieceFilePath := path.Join(l.pieceTemplateDir, "staged-file")
-	pieceinfos := path.Join(l.pieceTemplateDir, "piece-info.json")
-
-	// soft link file to staged path
-	err = os.Symlink(pieceFilePath, stagedPath.Unsealed)
-	if err != nil {
-		log.Errorf("loadPieceTemplate Symlink failed:%v", err)
-		return abi.PieceInfo{}, xerrors.Errorf("loadPieceTemplate %w", err)
-	}
-
-	// read pieceCID from json file
-	bb, err := ioutil.ReadFile(pieceinfos)
-	if err != nil {
-		log.Errorf("loadPieceTemplate ReadAll failed:%v", err)
-		return abi.PieceInfo{}, xerrors.Errorf("loadPieceTemplate: %w", err)
-	}
-
-	pi := abi.PieceInfo{}
-	err = json.Unmarshal(bb, &pi)
-	if err != nil {
-		log.Errorf("loadPieceTemplate Unmarshal failed:%v", err)
+	if err := reflinkOrCopy(tmpl.Path, stagedPath.Unsealed); err != nil {
+		log.Errorf("loadPieceTemplate staging failed:%v", err)
 		return abi.PieceInfo{}, xerrors.Errorf("loadPieceTemplate: %w", err)
 	}
 
 	log.Debugf("loadPieceTemplate completed, sector:%v", sector)
-	return pi, nil
+	return abi.PieceInfo{Size: tmpl.PieceSize.Padded(), PieceCID: tmpl.PieceCID}, nil
+}
+
+// AddPieceTemplate registers path as a reusable piece template for sectors
+// of size ssize and pieces of size psize, so a future AddPiece matching
+// both can skip straight to loadPieceTemplate instead of running the real
+// sealing pipeline. See PieceTemplateStore.Add.
+func (l *LocalWorker) AddPieceTemplate(ctx context.Context, ssize abi.SectorSize, psize abi.UnpaddedPieceSize, pieceCID cid.Cid, path string) (PieceTemplateInfo, error) {
+	return l.pieceTemplates.Add(ssize, psize, pieceCID, path)
+}
+
+// ListPieceTemplates returns every piece template currently registered with
+// this worker.
+func (l *LocalWorker) ListPieceTemplates(ctx context.Context) ([]PieceTemplateInfo, error) {
+	return l.pieceTemplates.List(), nil
+}
+
+// RemovePieceTemplate unregisters a piece template and deletes its backing
+// data, so an operator can rotate templates without restarting the worker.
+func (l *LocalWorker) RemovePieceTemplate(ctx context.Context, ssize abi.SectorSize, psize abi.UnpaddedPieceSize, pieceCID cid.Cid) error {
+	return l.pieceTemplates.Remove(ssize, psize, pieceCID)
 }
 
 func (l *LocalWorker) Fetch(ctx context.Context, sector storage.SectorRef, fileType storiface.SectorFileType, ptype storiface.PathType, am storiface.AcquireMode) (storiface.CallID, error) {
-	return l.asyncCall(ctx, sector, Fetch, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
+	return l.asyncCall(ctx, sector, Fetch, nil, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
 		_, done, err := (&localWorkerPathProvider{w: l, op: am}).AcquireSector(ctx, sector, fileType, storiface.FTNone, ptype)
 		if err == nil {
 			done()
@@ -508,81 +619,151 @@ func (l *LocalWorker) Fetch(ctx context.Context, sector storage.SectorRef, fileT
 	})
 }
 
-func (l *LocalWorker) SealPreCommit1(ctx context.Context, sector storage.SectorRef, ticket abi.SealRandomness, pieces []abi.PieceInfo) (storiface.CallID, error) {
-	return l.asyncCall(ctx, sector, SealPreCommit1, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
+func (l *LocalWorker) doSealPreCommit1(ctx context.Context, sector storage.SectorRef, ticket abi.SealRandomness, pieces []abi.PieceInfo) (interface{}, error) {
+	// cleanup previous failed attempts if they exist
+	if err := l.storage.Remove(ctx, sector.ID, storiface.FTSealed, true); err != nil {
+		return nil, xerrors.Errorf("cleaning up sealed data: %w", err)
+	}
 
-		{
-			// cleanup previous failed attempts if they exist
-			if err := l.storage.Remove(ctx, sector.ID, storiface.FTSealed, true); err != nil {
-				return nil, xerrors.Errorf("cleaning up sealed data: %w", err)
-			}
+	if err := l.storage.Remove(ctx, sector.ID, storiface.FTCache, true); err != nil {
+		return nil, xerrors.Errorf("cleaning up cache data: %w", err)
+	}
 
-			if err := l.storage.Remove(ctx, sector.ID, storiface.FTCache, true); err != nil {
-				return nil, xerrors.Errorf("cleaning up cache data: %w", err)
-			}
-		}
+	sb, err := l.executor()
+	if err != nil {
+		return nil, err
+	}
 
-		sb, err := l.executor()
-		if err != nil {
-			return nil, err
-		}
+	release, err := l.p1Gate.Acquire(ctx, TaskGateRequest{Weight: gateWeightForSector(sector)})
+	if err != nil {
+		return nil, xerrors.Errorf("acquiring PC1 task gate: %w", err)
+	}
 
-		// lock P1 mutex
-		l.p1Mutex.Lock()
-		l.counterTask(sealtasks.TTPreCommit1, 1)
-		defer func() {
-			l.p1Mutex.Unlock()
-			l.counterTask(sealtasks.TTPreCommit1, -1)
-		}()
+	l.counterTask(sealtasks.TTPreCommit1, 1)
+	defer func() {
+		release()
+		l.counterTask(sealtasks.TTPreCommit1, -1)
+	}()
 
-		return sb.SealPreCommit1(ctx, sector, ticket, pieces)
+	return sb.SealPreCommit1(ctx, sector, ticket, pieces)
+}
+
+func (l *LocalWorker) SealPreCommit1(ctx context.Context, sector storage.SectorRef, ticket abi.SealRandomness, pieces []abi.PieceInfo) (storiface.CallID, error) {
+	resume := &resumeArgs{Ticket: ticket, Pieces: pieces}
+
+	return l.asyncCall(ctx, sector, SealPreCommit1, resume, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
+		return l.doSealPreCommit1(ctx, sector, ticket, pieces)
 	})
 }
 
-func (l *LocalWorker) SealPreCommit2(ctx context.Context, sector storage.SectorRef, phase1Out storage.PreCommit1Out) (storiface.CallID, error) {
+// resumeSealPreCommit1 re-dispatches a SealPreCommit1 checkpointed before an
+// earlier worker process exited mid-seal, reusing ci so the manager's
+// existing wait on that CallID is satisfied the normal way once the
+// re-dispatched call finishes.
+func (l *LocalWorker) resumeSealPreCommit1(ci storiface.CallID, sector storage.SectorRef, ra *resumeArgs) (storiface.CallID, error) {
+	return l.asyncCallWithID(context.TODO(), sector, ci, SealPreCommit1, ra, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
+		return l.doSealPreCommit1(ctx, sector, ra.Ticket, ra.Pieces)
+	})
+}
+
+func (l *LocalWorker) doSealPreCommit2(ctx context.Context, sector storage.SectorRef, phase1Out storage.PreCommit1Out) (interface{}, error) {
 	sb, err := l.executor()
 	if err != nil {
-		return storiface.UndefCall, err
+		return nil, err
 	}
 
-	return l.asyncCall(ctx, sector, SealPreCommit2, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
-		l.p2Mutex.Lock()
-		l.counterTask(sealtasks.TTPreCommit2, 1)
-		defer func() {
-			l.p2Mutex.Unlock()
-			l.counterTask(sealtasks.TTPreCommit2, -1)
-		}()
+	release, err := l.p2Gate.Acquire(ctx, TaskGateRequest{Weight: gateWeightForSector(sector)})
+	if err != nil {
+		return nil, xerrors.Errorf("acquiring PC2 task gate: %w", err)
+	}
+
+	l.counterTask(sealtasks.TTPreCommit2, 1)
+	defer func() {
+		release()
+		l.counterTask(sealtasks.TTPreCommit2, -1)
+	}()
+
+	return sb.SealPreCommit2(ctx, sector, phase1Out)
+}
 
-		return sb.SealPreCommit2(ctx, sector, phase1Out)
+func (l *LocalWorker) SealPreCommit2(ctx context.Context, sector storage.SectorRef, phase1Out storage.PreCommit1Out) (storiface.CallID, error) {
+	resume := &resumeArgs{Phase1Out: phase1Out}
+
+	return l.asyncCall(ctx, sector, SealPreCommit2, resume, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
+		return l.doSealPreCommit2(ctx, sector, phase1Out)
 	})
 }
 
-func (l *LocalWorker) SealCommit1(ctx context.Context, sector storage.SectorRef, ticket abi.SealRandomness, seed abi.InteractiveSealRandomness, pieces []abi.PieceInfo, cids storage.SectorCids) (storiface.CallID, error) {
+func (l *LocalWorker) resumeSealPreCommit2(ci storiface.CallID, sector storage.SectorRef, ra *resumeArgs) (storiface.CallID, error) {
+	return l.asyncCallWithID(context.TODO(), sector, ci, SealPreCommit2, ra, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
+		return l.doSealPreCommit2(ctx, sector, storage.PreCommit1Out(ra.Phase1Out))
+	})
+}
+
+func (l *LocalWorker) doSealCommit1(ctx context.Context, sector storage.SectorRef, ticket abi.SealRandomness, seed abi.InteractiveSealRandomness, pieces []abi.PieceInfo, cids storage.SectorCids) (interface{}, error) {
 	sb, err := l.executor()
 	if err != nil {
-		return storiface.UndefCall, err
+		return nil, err
 	}
 
-	return l.asyncCall(ctx, sector, SealCommit1, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
-		return sb.SealCommit1(ctx, sector, ticket, seed, pieces, cids)
+	return sb.SealCommit1(ctx, sector, ticket, seed, pieces, cids)
+}
+
+func (l *LocalWorker) SealCommit1(ctx context.Context, sector storage.SectorRef, ticket abi.SealRandomness, seed abi.InteractiveSealRandomness, pieces []abi.PieceInfo, cids storage.SectorCids) (storiface.CallID, error) {
+	resume := &resumeArgs{Ticket: ticket, Seed: seed, Pieces: pieces, Cids: &cids}
+
+	return l.asyncCall(ctx, sector, SealCommit1, resume, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
+		return l.doSealCommit1(ctx, sector, ticket, seed, pieces, cids)
 	})
 }
 
-func (l *LocalWorker) SealCommit2(ctx context.Context, sector storage.SectorRef, phase1Out storage.Commit1Out) (storiface.CallID, error) {
+func (l *LocalWorker) resumeSealCommit1(ci storiface.CallID, sector storage.SectorRef, ra *resumeArgs) (storiface.CallID, error) {
+	return l.asyncCallWithID(context.TODO(), sector, ci, SealCommit1, ra, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
+		return l.doSealCommit1(ctx, sector, ra.Ticket, ra.Seed, ra.Pieces, *ra.Cids)
+	})
+}
+
+func (l *LocalWorker) doSealCommit2(ctx context.Context, ci storiface.CallID, sector storage.SectorRef, phase1Out storage.Commit1Out) (interface{}, error) {
 	sb, err := l.executor()
 	if err != nil {
-		return storiface.UndefCall, err
+		return nil, err
 	}
 
-	return l.asyncCall(ctx, sector, SealCommit2, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
-		l.c2Mutex.Lock()
-		l.counterTask(sealtasks.TTCommit2, 1)
-		defer func() {
-			l.c2Mutex.Unlock()
-			l.counterTask(sealtasks.TTCommit2, -1)
-		}()
+	release, err := l.c2Gate.Acquire(ctx, TaskGateRequest{Weight: gateWeightForSector(sector)})
+	if err != nil {
+		return nil, xerrors.Errorf("acquiring C2 task gate: %w", err)
+	}
+
+	l.counterTask(sealtasks.TTCommit2, 1)
+	reserved := l.vram.reserve(defaultGPUVRAMBytes)
+	defer func() {
+		if reserved {
+			l.vram.release(defaultGPUVRAMBytes)
+			l.emitResourceReleased(ci, SealCommit2)
+		}
+		release()
+		l.counterTask(sealtasks.TTCommit2, -1)
+	}()
+
+	if !reserved {
+		return nil, xerrors.Errorf("not enough VRAM budget free for C2 sector %v", sector.ID)
+	}
+	l.emitResourceReserved(ci, SealCommit2)
+
+	return sb.SealCommit2(ctx, sector, phase1Out)
+}
 
-		return sb.SealCommit2(ctx, sector, phase1Out)
+func (l *LocalWorker) SealCommit2(ctx context.Context, sector storage.SectorRef, phase1Out storage.Commit1Out) (storiface.CallID, error) {
+	resume := &resumeArgs{Phase1Out: phase1Out}
+
+	return l.asyncCall(ctx, sector, SealCommit2, resume, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
+		return l.doSealCommit2(ctx, ci, sector, phase1Out)
+	})
+}
+
+func (l *LocalWorker) resumeSealCommit2(ci storiface.CallID, sector storage.SectorRef, ra *resumeArgs) (storiface.CallID, error) {
+	return l.asyncCallWithID(context.TODO(), sector, ci, SealCommit2, ra, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
+		return l.doSealCommit2(ctx, ci, sector, storage.Commit1Out(ra.Phase1Out))
 	})
 }
 
@@ -592,7 +773,7 @@ func (l *LocalWorker) FinalizeSector(ctx context.Context, sector storage.SectorR
 		return storiface.UndefCall, err
 	}
 
-	return l.asyncCall(ctx, sector, FinalizeSector, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
+	return l.asyncCall(ctx, sector, FinalizeSector, nil, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
 		if err := sb.FinalizeSector(ctx, sector, keepUnsealed); err != nil {
 			return nil, xerrors.Errorf("finalizing sector: %w", err)
 		}
@@ -630,7 +811,7 @@ func (l *LocalWorker) Remove(ctx context.Context, sector abi.SectorID) error {
 }
 
 func (l *LocalWorker) MoveStorage(ctx context.Context, sector storage.SectorRef, types storiface.SectorFileType) (storiface.CallID, error) {
-	return l.asyncCall(ctx, sector, MoveStorage, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
+	return l.asyncCall(ctx, sector, MoveStorage, nil, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
 		return nil, l.storage.MoveStorage(ctx, sector, types)
 	})
 }
@@ -641,7 +822,7 @@ func (l *LocalWorker) UnsealPiece(ctx context.Context, sector storage.SectorRef,
 		return storiface.UndefCall, err
 	}
 
-	return l.asyncCall(ctx, sector, UnsealPiece, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
+	return l.asyncCall(ctx, sector, UnsealPiece, nil, func(ctx context.Context, ci storiface.CallID) (interface{}, error) {
 		log.Debugf("worker will unseal piece now, sector=%+v", sector.ID)
 		if err = sb.UnsealPiece(ctx, sector, index, size, randomness, cid); err != nil {
 			return nil, xerrors.Errorf("unsealing sector: %w", err)
@@ -700,21 +881,67 @@ func (l *LocalWorker) counterTask(tasktype sealtasks.TaskType, c int) {
 	}
 }
 
+// taskResourceRequirements is the minimum free RAM/VRAM HasResourceForNewTask
+// requires on top of the per-type parallelism cap (the TaskGate capacity
+// for P1/P2/C2, parallelConfig otherwise), before admitting one more task
+// of that type. Task types
+// absent here only go through the parallelism check, as before.
+var taskResourceRequirements = map[sealtasks.TaskType]struct {
+	MinFreeRAM  uint64
+	MinFreeVRAM uint64
+}{
+	sealtasks.TTPreCommit2: {MinFreeRAM: 32 << 30},
+	sealtasks.TTCommit2:    {MinFreeRAM: 8 << 30, MinFreeVRAM: defaultGPUVRAMBytes},
+}
+
 func (l *LocalWorker) HasResourceForNewTask(ctx context.Context, tasktype sealtasks.TaskType) bool {
 	l.taskLk.Lock()
-	defer l.taskLk.Unlock()
-
 	count, exist := l.runningTasks[tasktype]
-	if !exist {
-		return true
+	taskParallelCount := int(parallelConfig[tasktype])
+	if n, ok := l.gateConcurrency[tasktype]; ok {
+		// TTPreCommit1/TTPreCommit2/TTCommit2 go through a TaskGate whose
+		// capacity is operator-configurable via WorkerConfig.
+		// TaskGateConcurrency; parallelConfig's cap for those types is just
+		// the pre-TaskGate default (1) and would otherwise make this check
+		// reject a task the gate itself is willing to admit.
+		taskParallelCount = n
+	}
+	l.taskLk.Unlock()
+
+	if exist && count >= taskParallelCount {
+		return false
 	}
 
-	taskParallelCount := parallelConfig[tasktype]
-	if count < int(taskParallelCount) {
+	req, ok := taskResourceRequirements[tasktype]
+	if !ok {
 		return true
 	}
 
-	return false
+	if req.MinFreeRAM > 0 {
+		// l.resources.MemUsed is only a snapshot from worker startup (see
+		// newLocalWorker); admitting PC2 against it would decide against
+		// stale memory data, same reason ResourceStats re-probes live
+		// figures instead of returning l.resources as-is.
+		fresh, err := probeResources(l.noSwap, storiface.WorkerResources{})
+		if err != nil {
+			log.Errorf("probing worker resources for admission check: %+v", err)
+			return false
+		}
+
+		used := l.resources.MemReserved + fresh.MemUsed
+		if used > l.resources.MemPhysical {
+			return false
+		}
+		if l.resources.MemPhysical-used < req.MinFreeRAM {
+			return false
+		}
+	}
+
+	if req.MinFreeVRAM > 0 && l.vram.free() < req.MinFreeVRAM {
+		return false
+	}
+
+	return true
 }
 
 func (l *LocalWorker) Info(context.Context) (storiface.WorkerInfo, error) {
@@ -723,26 +950,6 @@ func (l *LocalWorker) Info(context.Context) (storiface.WorkerInfo, error) {
 		panic(err)
 	}
 
-	// gpus, err := ffi.GetGPUDevices()
-	// if err != nil {
-	// 	log.Errorf("getting gpu devices failed: %+v", err)
-	// }
-
-	// h, err := sysinfo.Host()
-	// if err != nil {
-	// 	return storiface.WorkerInfo{}, xerrors.Errorf("getting host info: %w", err)
-	// }
-
-	// mem, err := h.Memory()
-	// if err != nil {
-	// 	return storiface.WorkerInfo{}, xerrors.Errorf("getting memory info: %w", err)
-	// }
-
-	// memSwap := mem.VirtualTotal
-	// if l.noSwap {
-	// 	memSwap = 0
-	// }
-
 	res := l.getWorkerResourceConfig()
 
 	return storiface.WorkerInfo{
@@ -752,6 +959,41 @@ func (l *LocalWorker) Info(context.Context) (storiface.WorkerInfo, error) {
 	}, nil
 }
 
+// ResourceStats reports LocalWorker's current resource usage snapshot for
+// operator/monitoring consumption (see Worker.ResourceStats). Unlike Info,
+// which most callers treat as near-static scheduling input, this refreshes
+// the live memory figures on every call.
+func (l *LocalWorker) ResourceStats(context.Context) (storiface.WorkerResources, error) {
+	fresh, err := probeResources(l.noSwap, storiface.WorkerResources{})
+	if err != nil {
+		return l.getWorkerResourceConfig(), err
+	}
+
+	// CPUs/GPUs/NUMANodes don't change at runtime (and re-enumerating GPUs
+	// via ffi on every scrape is wasteful), so only the live memory figures
+	// come from this call's fresh probe; everything else - including any
+	// operator ResourceOverrides - comes from what was settled on at
+	// startup.
+	res := l.getWorkerResourceConfig()
+	res.MemUsed = fresh.MemUsed
+	res.MemSwapUsed = fresh.MemSwapUsed
+
+	return res, nil
+}
+
+// GateStats reports queue depth, in-flight count, and cumulative wait time
+// for each TaskGate this worker runs SealPreCommit1/SealPreCommit2/
+// SealCommit2 through, keyed by TaskType. Queue depth and in-flight count
+// are the same numbers Prometheus scrapes via gateQueueDepth/gateInFlight in
+// worker_taskgate.go; TotalWait and TotalServed are only exposed here.
+func (l *LocalWorker) GateStats(context.Context) (map[sealtasks.TaskType]TaskGateStats, error) {
+	return map[sealtasks.TaskType]TaskGateStats{
+		sealtasks.TTPreCommit1: l.p1Gate.Stats(),
+		sealtasks.TTPreCommit2: l.p2Gate.Stats(),
+		sealtasks.TTCommit2:    l.c2Gate.Stats(),
+	}, nil
+}
+
 var parallelConfig = map[sealtasks.TaskType]uint32{
 	sealtasks.TTAddPiece:   1,
 	sealtasks.TTCommit1:    8,
@@ -761,12 +1003,24 @@ var parallelConfig = map[sealtasks.TaskType]uint32{
 	sealtasks.TTFinalize:   1,
 }
 
+// getWorkerResourceConfig returns the discovered/overridden CPU, memory and
+// GPU resources (see probeResources), annotated with each accepted task
+// type's current parallelism cap.
 func (l *LocalWorker) getWorkerResourceConfig() storiface.WorkerResources {
 	l.taskLk.Lock()
 	defer l.taskLk.Unlock()
-	res := storiface.WorkerResources{}
+
+	res := l.resources
 	for k := range l.acceptTasks {
-		kk, _ := parallelConfig[k]
+		kk := parallelConfig[k]
+		if n, ok := l.gateConcurrency[k]; ok {
+			// Advertise the operator-configured TaskGate capacity (see
+			// HasResourceForNewTask), not the old hardcoded default: a
+			// scheduler that dispatches against Info()/ResourceStats's
+			// advertised P1/P2/C2 counts should see the same concurrency
+			// the gate and admission check actually allow.
+			kk = uint32(n)
+		}
 		switch k {
 		case sealtasks.TTAddPiece:
 			res.AP = kk
@@ -0,0 +1,355 @@
+package sectorstorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/lotus/extern/sector-storage/ffiwrapper"
+)
+
+// pieceTemplateKey identifies one registered template by the dimensions
+// AddPiece actually matches on: the sector it's meant to be staged into and
+// the piece itself. The old single-slot hasPieceTemplate/loadPieceTemplate
+// only ever had one of these to compare against, so it didn't need a key at
+// all; PieceTemplateStore generalizes that to arbitrarily many templates.
+type pieceTemplateKey struct {
+	SectorSize abi.SectorSize
+	PieceSize  abi.UnpaddedPieceSize
+	PieceCID   cid.Cid
+}
+
+func (k pieceTemplateKey) String() string {
+	return fmt.Sprintf("%d-%d-%s", k.SectorSize, k.PieceSize, k.PieceCID)
+}
+
+// PieceTemplateInfo describes one registered template, for callers (e.g. the
+// ListPieceTemplates admin RPC) that shouldn't see the store's internal
+// locking or on-disk layout.
+type PieceTemplateInfo struct {
+	SectorSize abi.SectorSize
+	PieceSize  abi.UnpaddedPieceSize
+	PieceCID   cid.Cid
+	Path       string
+}
+
+func (i PieceTemplateInfo) key() pieceTemplateKey {
+	return pieceTemplateKey{SectorSize: i.SectorSize, PieceSize: i.PieceSize, PieceCID: i.PieceCID}
+}
+
+// pieceTemplateMeta is piece-info.json's on-disk shape. It carries the same
+// PieceCID the old format did, plus the sector/piece size PieceTemplateStore
+// needs to key templates that didn't exist when only one template could be
+// registered at a time.
+type pieceTemplateMeta struct {
+	SectorSize abi.SectorSize        `json:"sector_size"`
+	PieceSize  abi.UnpaddedPieceSize `json:"piece_size"`
+	PieceCID   cid.Cid               `json:"piece_cid"`
+}
+
+type pieceTemplate struct {
+	info PieceTemplateInfo
+	dir  string // directory holding staged-file + piece-info.json
+}
+
+// PieceTemplateStore holds every piece template registered with this worker,
+// one subdirectory of dir per template (each a staged-file + piece-info.json
+// pair - the same layout the old single-slot pieceTemplateDir used), keyed
+// by (sector size, piece size, piece CID) so AddPiece can pick the template
+// that actually matches a request instead of the one template that happened
+// to be configured.
+type PieceTemplateStore struct {
+	mu        sync.RWMutex
+	dir       string
+	templates map[pieceTemplateKey]*pieceTemplate
+}
+
+// NewPieceTemplateStore loads every template already registered under dir.
+// dir == "" is valid and yields a store with nothing in it (equivalent to
+// the old pieceTemplateDir == "" case: AddPiece always falls back to
+// sb.AddPiece).
+func NewPieceTemplateStore(dir string) (*PieceTemplateStore, error) {
+	s := &PieceTemplateStore{
+		dir:       dir,
+		templates: map[pieceTemplateKey]*pieceTemplate{},
+	}
+
+	if dir == "" {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, xerrors.Errorf("creating piece template dir: %w", err)
+	}
+
+	ents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, xerrors.Errorf("listing piece template dir: %w", err)
+	}
+
+	for _, ent := range ents {
+		if !ent.IsDir() {
+			continue
+		}
+
+		tdir := filepath.Join(dir, ent.Name())
+		pt, err := loadPieceTemplateDir(tdir)
+		if err != nil {
+			log.Warnf("skipping invalid piece template %s: %+v", tdir, err)
+			continue
+		}
+
+		s.templates[pt.info.key()] = pt
+	}
+
+	return s, nil
+}
+
+func loadPieceTemplateDir(tdir string) (*pieceTemplate, error) {
+	stagedPath := filepath.Join(tdir, "staged-file")
+	metaPath := filepath.Join(tdir, "piece-info.json")
+
+	mb, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		return nil, xerrors.Errorf("reading piece-info.json: %w", err)
+	}
+
+	var meta pieceTemplateMeta
+	if err := json.Unmarshal(mb, &meta); err != nil {
+		return nil, xerrors.Errorf("parsing piece-info.json: %w", err)
+	}
+
+	if err := verifyPieceTemplateCID(stagedPath, meta.SectorSize, meta.PieceCID); err != nil {
+		return nil, xerrors.Errorf("verifying template CID: %w", err)
+	}
+
+	return &pieceTemplate{
+		dir: tdir,
+		info: PieceTemplateInfo{
+			SectorSize: meta.SectorSize,
+			PieceSize:  meta.PieceSize,
+			PieceCID:   meta.PieceCID,
+			Path:       stagedPath,
+		},
+	}, nil
+}
+
+// verifyPieceTemplateCID recomputes staged-file's piece CID and checks it
+// against what piece-info.json claims, so a template directory that was
+// copied in wrong - or just bit-rotted on disk - gets rejected up front
+// instead of silently handing AddPiece the wrong bytes under the right
+// label.
+func verifyPieceTemplateCID(stagedPath string, ssize abi.SectorSize, want cid.Cid) error {
+	f, err := os.Open(stagedPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	got, err := ffiwrapper.GeneratePieceCIDFromFile(proofTypeForSectorSize(ssize), f, abi.UnpaddedPieceSize(fi.Size()))
+	if err != nil {
+		return xerrors.Errorf("computing piece CID: %w", err)
+	}
+
+	if !got.Equals(want) {
+		return xerrors.Errorf("piece CID mismatch: staged-file hashes to %s, piece-info.json claims %s", got, want)
+	}
+
+	return nil
+}
+
+// proofTypeForSectorSize picks any RegisteredSealProof with the given sector
+// size purely so GeneratePieceCIDFromFile has one to work with - CommP only
+// depends on the Fr32 padding tree shape (a function of sector size), not on
+// which specific proof variant (V1/V1_1) ends up sealing the sector.
+func proofTypeForSectorSize(ssize abi.SectorSize) abi.RegisteredSealProof {
+	switch ssize {
+	case 2 << 10:
+		return abi.RegisteredSealProof_StackedDrg2KiBV1
+	case 8 << 20:
+		return abi.RegisteredSealProof_StackedDrg8MiBV1
+	case 512 << 20:
+		return abi.RegisteredSealProof_StackedDrg512MiBV1
+	case 64 << 30:
+		return abi.RegisteredSealProof_StackedDrg64GiBV1
+	default:
+		return abi.RegisteredSealProof_StackedDrg32GiBV1
+	}
+}
+
+// Add registers path (a complete staged-file for a piece of size psize
+// destined for a sector of size ssize, claiming CID pieceCID) as a
+// template. The data is reflinked (FICLONE) into the store's directory
+// where the backing filesystem supports it, falling back to a plain copy
+// otherwise, so the caller's original file can be removed or reused right
+// after this returns.
+func (s *PieceTemplateStore) Add(ssize abi.SectorSize, psize abi.UnpaddedPieceSize, pieceCID cid.Cid, path string) (PieceTemplateInfo, error) {
+	if s.dir == "" {
+		return PieceTemplateInfo{}, xerrors.Errorf("piece template store has no backing directory configured")
+	}
+
+	if err := verifyPieceTemplateCID(path, ssize, pieceCID); err != nil {
+		return PieceTemplateInfo{}, err
+	}
+
+	key := pieceTemplateKey{SectorSize: ssize, PieceSize: psize, PieceCID: pieceCID}
+	tdir := filepath.Join(s.dir, key.String())
+
+	if err := os.MkdirAll(tdir, 0755); err != nil {
+		return PieceTemplateInfo{}, xerrors.Errorf("creating template dir: %w", err)
+	}
+
+	stagedPath := filepath.Join(tdir, "staged-file")
+	if err := reflinkOrCopy(path, stagedPath); err != nil {
+		return PieceTemplateInfo{}, xerrors.Errorf("copying template data: %w", err)
+	}
+
+	meta := pieceTemplateMeta{SectorSize: ssize, PieceSize: psize, PieceCID: pieceCID}
+	mb, err := json.Marshal(meta)
+	if err != nil {
+		return PieceTemplateInfo{}, xerrors.Errorf("marshaling template metadata: %w", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tdir, "piece-info.json"), mb, 0644); err != nil {
+		return PieceTemplateInfo{}, xerrors.Errorf("writing template metadata: %w", err)
+	}
+
+	info := PieceTemplateInfo{SectorSize: ssize, PieceSize: psize, PieceCID: pieceCID, Path: stagedPath}
+
+	s.mu.Lock()
+	s.templates[key] = &pieceTemplate{dir: tdir, info: info}
+	s.mu.Unlock()
+
+	return info, nil
+}
+
+// List returns every currently registered template.
+func (s *PieceTemplateStore) List() []PieceTemplateInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make([]PieceTemplateInfo, 0, len(s.templates))
+	for _, t := range s.templates {
+		out = append(out, t.info)
+	}
+	return out
+}
+
+// Remove unregisters a template and deletes its backing directory.
+func (s *PieceTemplateStore) Remove(ssize abi.SectorSize, psize abi.UnpaddedPieceSize, pieceCID cid.Cid) error {
+	key := pieceTemplateKey{SectorSize: ssize, PieceSize: psize, PieceCID: pieceCID}
+
+	s.mu.Lock()
+	t, ok := s.templates[key]
+	if ok {
+		delete(s.templates, key)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return xerrors.Errorf("no piece template registered for %s", key)
+	}
+
+	return os.RemoveAll(t.dir)
+}
+
+// BestFit returns the template best matching an AddPiece request of size
+// psize into a sector of size ssize, or ok=false if AddPiece should fall
+// back to sb.AddPiece.
+//
+// Unlike the old hasPieceTemplate (any template at or above "size <=
+// pieceTemplateSize"), a match requires the exact sector/piece size: that
+// loose check only worked because there was exactly one template to
+// compare against, and silently handing out wrong-sized bytes once
+// multiple templates coexist is worse than not matching at all. If the
+// caller already knows the piece it wants (pieceCID != cid.Undef), that
+// must match too.
+func (s *PieceTemplateStore) BestFit(ssize abi.SectorSize, psize abi.UnpaddedPieceSize, pieceCID cid.Cid) (PieceTemplateInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if pieceCID != cid.Undef {
+		t, ok := s.templates[pieceTemplateKey{SectorSize: ssize, PieceSize: psize, PieceCID: pieceCID}]
+		if !ok {
+			return PieceTemplateInfo{}, false
+		}
+		return t.info, true
+	}
+
+	for k, t := range s.templates {
+		if k.SectorSize == ssize && k.PieceSize == psize {
+			return t.info, true
+		}
+	}
+
+	return PieceTemplateInfo{}, false
+}
+
+// reflinkOrCopy stages a piece template's data at dst, reflinking (FICLONE)
+// from src where the filesystem supports copy-on-write clones and falling
+// back to a regular copy otherwise. A reflink lets downstream sealing
+// stages mutate the unsealed file in place without corrupting the
+// template, which a bare symlink (the old loadPieceTemplate's approach)
+// can't guarantee.
+func reflinkOrCopy(src, dst string) error {
+	if err := reflink(src, dst); err == nil {
+		return nil
+	}
+
+	return copyFile(src, dst)
+}
+
+func reflink(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close() // nolint
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close() // nolint
+
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err != nil {
+		os.Remove(dst) // nolint
+		return xerrors.Errorf("FICLONE: %w", err)
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close() // nolint
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close() // nolint
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,181 @@
+package sectorstorage
+
+import (
+	"os"
+	"regexp"
+	"runtime"
+	"sync"
+
+	"github.com/elastic/go-sysinfo"
+	"golang.org/x/xerrors"
+
+	ffi "github.com/filecoin-project/filecoin-ffi"
+
+	"github.com/filecoin-project/lotus/extern/sector-storage/storiface"
+)
+
+// reservedMemoryOverhead is subtracted from the discovered MemPhysical
+// before it's reported, rounding off some slack for the OS/other processes
+// rather than advertising every last byte as available for sealing.
+const reservedMemoryOverhead = 1 << 30 // 1GiB
+
+// probeResources discovers this host's CPU count, memory/swap, and GPUs,
+// then lets any non-zero field in overrides replace what was discovered -
+// an operator who knows better (e.g. a GPU allocator already carved out
+// VRAM for something else, or a cgroup limit autodetection can't see)
+// should be able to pin the value LocalWorker advertises instead of fighting
+// with probing logic.
+func probeResources(noSwap bool, overrides storiface.WorkerResources) (storiface.WorkerResources, error) {
+	h, err := sysinfo.Host()
+	if err != nil {
+		return storiface.WorkerResources{}, xerrors.Errorf("getting host info: %w", err)
+	}
+
+	mem, err := h.Memory()
+	if err != nil {
+		return storiface.WorkerResources{}, xerrors.Errorf("getting memory info: %w", err)
+	}
+
+	memSwap := mem.VirtualTotal
+	memSwapUsed := mem.VirtualUsed
+	if noSwap {
+		memSwap = 0
+		memSwapUsed = 0
+	}
+
+	gpus, err := ffi.GetGPUDevices()
+	if err != nil {
+		log.Errorf("getting gpu devices failed: %+v", err)
+		gpus = nil
+	}
+
+	res := storiface.WorkerResources{
+		MemPhysical: mem.Total,
+		MemUsed:     mem.Total - mem.Available,
+		MemReserved: reservedMemoryOverhead,
+		MemSwap:     memSwap,
+		MemSwapUsed: memSwapUsed,
+		CPUs:        uint64(runtime.NumCPU()),
+		NUMANodes:   uint64(numaNodeCount()),
+		GPUs:        gpus,
+	}
+
+	applyResourceOverrides(&res, overrides)
+
+	return res, nil
+}
+
+// applyResourceOverrides replaces every non-zero field of overrides onto
+// res in place.
+func applyResourceOverrides(res *storiface.WorkerResources, overrides storiface.WorkerResources) {
+	if overrides.MemPhysical != 0 {
+		res.MemPhysical = overrides.MemPhysical
+	}
+	if overrides.MemUsed != 0 {
+		res.MemUsed = overrides.MemUsed
+	}
+	if overrides.MemReserved != 0 {
+		res.MemReserved = overrides.MemReserved
+	}
+	if overrides.MemSwap != 0 {
+		res.MemSwap = overrides.MemSwap
+	}
+	if overrides.MemSwapUsed != 0 {
+		res.MemSwapUsed = overrides.MemSwapUsed
+	}
+	if overrides.CPUs != 0 {
+		res.CPUs = overrides.CPUs
+	}
+	if overrides.NUMANodes != 0 {
+		res.NUMANodes = overrides.NUMANodes
+	}
+	if len(overrides.GPUs) != 0 {
+		res.GPUs = overrides.GPUs
+	}
+}
+
+var numaNodeRe = regexp.MustCompile(`^node\d+$`)
+
+// numaNodeCount returns the number of NUMA nodes this host reports under
+// /sys/devices/system/node, or 1 if that doesn't exist (non-Linux, or a
+// single-node machine with no NUMA support compiled in) or can't be read.
+// Nothing currently schedules against this beyond surfacing it for
+// operators inspecting Worker.ResourceStats; pinning sealing work to a node
+// is a scheduler-side feature, not a worker-side one.
+func numaNodeCount() int {
+	ents, err := os.ReadDir("/sys/devices/system/node")
+	if err != nil {
+		return 1
+	}
+
+	count := 0
+	for _, e := range ents {
+		if numaNodeRe.MatchString(e.Name()) {
+			count++
+		}
+	}
+	if count == 0 {
+		return 1
+	}
+	return count
+}
+
+// gpuMemTracker is a best-effort stand-in for a real NVML/AMD-SMI VRAM
+// query: this repo doesn't vendor either binding, so instead of querying
+// actual device free memory, it tracks how much VRAM LocalWorker's own C2
+// tasks have claimed out of the discovered devices' (assumed-equal) budget.
+// HasResourceForNewTask uses it to avoid admitting a C2 it already knows
+// won't fit, not to make hard real-time guarantees about the GPU.
+type gpuMemTracker struct {
+	mu       sync.Mutex
+	perGPU   uint64 // assumed VRAM budget per discovered GPU, bytes
+	reserved uint64
+	numGPUs  int
+}
+
+func newGPUMemTracker(perGPU uint64, numGPUs int) *gpuMemTracker {
+	return &gpuMemTracker{perGPU: perGPU, numGPUs: numGPUs}
+}
+
+func (t *gpuMemTracker) free() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	total := t.perGPU * uint64(t.numGPUs)
+	if t.reserved >= total {
+		return 0
+	}
+	return total - t.reserved
+}
+
+// reserve claims n bytes of VRAM budget if there's enough free, returning
+// whether the claim succeeded.
+func (t *gpuMemTracker) reserve(n uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	total := t.perGPU * uint64(t.numGPUs)
+	if t.reserved+n > total {
+		return false
+	}
+	t.reserved += n
+	return true
+}
+
+func (t *gpuMemTracker) release(n uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n > t.reserved {
+		n = t.reserved
+	}
+	t.reserved -= n
+}
+
+// defaultGPUVRAMBytes is the per-GPU VRAM budget gpuMemTracker assumes for
+// every GPU; WorkerConfig.ResourceOverrides can change the GPU count (via
+// GPUs) but not this per-GPU figure. 11GiB
+// matches the smallest GPU lotus-miner operators have reported using for
+// C2 (e.g. a 2080Ti), so it's a conservative floor rather than a guess at
+// the high end.
+const defaultGPUVRAMBytes = 11 << 30
@@ -0,0 +1,321 @@
+package sectorstorage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/filecoin-project/specs-storage/storage"
+
+	"github.com/filecoin-project/lotus/extern/sector-storage/sealtasks"
+)
+
+// GatePolicy selects how a TaskGate orders waiters competing for its bounded
+// concurrency.
+type GatePolicy int
+
+const (
+	// FIFOPolicy serves waiters in ascending Priority order, and in arrival
+	// order among waiters of equal Priority. This is the de-facto policy
+	// p1Mutex/p2Mutex/c2Mutex had before TaskGate existed: one waiter queue,
+	// no fairness across sector sizes and no deadline awareness.
+	FIFOPolicy GatePolicy = iota
+	// WFQPolicy round-robins across waiters grouped by TaskGateRequest.
+	// Weight (a sector-size class), so a burst of large sectors can't
+	// head-of-line-block a small one indefinitely the way a plain FIFO
+	// queue would.
+	WFQPolicy
+	// EDFPolicy serves the waiter with the nearest non-zero Deadline first,
+	// falling back to FIFOPolicy ordering for requests with no deadline.
+	EDFPolicy
+)
+
+// TaskGateRequest describes one call competing for a TaskGate's bounded
+// concurrency.
+//
+// Priority and Deadline are best-effort: this worker only ever sees a
+// storage.SectorRef at the SealPreCommit1/SealPreCommit2/SealCommit2 call
+// sites, which carries no WindowPoSt/PreCommit deadline or scheduler
+// priority of its own - that metadata lives on the manager/scheduler side,
+// which isn't part of this package. EDFPolicy and priority-aware FIFO
+// ordering are ready for a caller that can supply them; today's callers
+// leave both zero-valued, which degrades to plain arrival order.
+type TaskGateRequest struct {
+	Priority int       // lower runs first; 0 if the caller doesn't distinguish
+	Deadline time.Time // zero means "no deadline"
+	Weight   int       // sector-size class key for WFQPolicy; ignored otherwise
+}
+
+// TaskGateStats is a point-in-time snapshot of a TaskGate's queue.
+type TaskGateStats struct {
+	QueueDepth  int
+	InFlight    int
+	TotalWait   time.Duration
+	TotalServed int64
+}
+
+// TaskGate arbitrates access to a limited resource (e.g. "one PC1 at a
+// time", or "two PC1s" on hardware that can run them concurrently) across
+// competing calls, replacing a single sync.Mutex. Acquire blocks until a
+// slot is free and req is next up under the gate's policy; the returned
+// release must be called exactly once to free the slot.
+type TaskGate interface {
+	Acquire(ctx context.Context, req TaskGateRequest) (release func(), err error)
+	Stats() TaskGateStats
+}
+
+type gateWaiter struct {
+	req      TaskGateRequest
+	seq      uint64
+	queuedAt time.Time
+	ready    chan struct{}
+}
+
+// taskGate is the only TaskGate implementation: a bounded-concurrency queue
+// whose admission order is picked by policy. Waiter counts at any one time
+// are small (bounded by how many sectors a miner is actively sealing), so
+// admitLocked just scans the waiter slice rather than maintaining a heap.
+type taskGate struct {
+	name     string // sealtasks.TaskType, for metric labels
+	policy   GatePolicy
+	capacity int
+
+	mu         sync.Mutex
+	inFlight   int
+	waiters    []*gateWaiter
+	nextSeq    uint64
+	wfqLastIdx int // index into the (deterministically ordered) weight classes last admitted from, for round robin
+
+	stats TaskGateStats
+}
+
+func newTaskGate(name string, policy GatePolicy, capacity int) *taskGate {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	return &taskGate{
+		name:     name,
+		policy:   policy,
+		capacity: capacity,
+	}
+}
+
+func (g *taskGate) Acquire(ctx context.Context, req TaskGateRequest) (func(), error) {
+	w := &gateWaiter{req: req, queuedAt: time.Now(), ready: make(chan struct{})}
+
+	g.mu.Lock()
+	w.seq = g.nextSeq
+	g.nextSeq++
+	g.waiters = append(g.waiters, w)
+	g.admitLocked()
+	g.reportLocked()
+	g.mu.Unlock()
+
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		g.mu.Lock()
+		g.removeWaiterLocked(w)
+		g.reportLocked()
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			g.mu.Lock()
+			g.inFlight--
+			g.admitLocked()
+			g.reportLocked()
+			g.mu.Unlock()
+		})
+	}
+
+	return release, nil
+}
+
+// admitLocked moves waiters from the queue into service until capacity is
+// exhausted or the queue is empty. Must hold g.mu.
+func (g *taskGate) admitLocked() {
+	for g.inFlight < g.capacity {
+		i := g.pickLocked()
+		if i < 0 {
+			return
+		}
+
+		w := g.waiters[i]
+		g.waiters = append(g.waiters[:i], g.waiters[i+1:]...)
+
+		g.inFlight++
+		g.stats.TotalWait += time.Since(w.queuedAt)
+		g.stats.TotalServed++
+
+		close(w.ready)
+	}
+}
+
+// pickLocked returns the index of the next waiter to admit under g.policy,
+// or -1 if g.waiters is empty.
+func (g *taskGate) pickLocked() int {
+	if len(g.waiters) == 0 {
+		return -1
+	}
+
+	switch g.policy {
+	case EDFPolicy:
+		best := -1
+		for i, w := range g.waiters {
+			if w.req.Deadline.IsZero() {
+				continue
+			}
+			if best < 0 || w.req.Deadline.Before(g.waiters[best].req.Deadline) {
+				best = i
+			}
+		}
+		if best >= 0 {
+			return best
+		}
+		return g.pickFIFOLocked()
+
+	case WFQPolicy:
+		return g.pickWFQLocked()
+
+	default:
+		return g.pickFIFOLocked()
+	}
+}
+
+// pickFIFOLocked returns the lowest-Priority, earliest-arrived waiter.
+func (g *taskGate) pickFIFOLocked() int {
+	best := 0
+	for i := 1; i < len(g.waiters); i++ {
+		a, b := g.waiters[i].req, g.waiters[best].req
+		if a.Priority != b.Priority {
+			if a.Priority < b.Priority {
+				best = i
+			}
+			continue
+		}
+		if g.waiters[i].seq < g.waiters[best].seq {
+			best = i
+		}
+	}
+	return best
+}
+
+// pickWFQLocked round-robins across the distinct Weight classes currently
+// waiting, picking the earliest-arrived waiter in whichever class is next
+// in rotation after the one last admitted from.
+func (g *taskGate) pickWFQLocked() int {
+	classes := make([]int, 0, 4)
+	seen := map[int]bool{}
+	for _, w := range g.waiters {
+		if !seen[w.req.Weight] {
+			seen[w.req.Weight] = true
+			classes = append(classes, w.req.Weight)
+		}
+	}
+	if len(classes) == 0 {
+		return -1
+	}
+
+	for step := 0; step < len(classes); step++ {
+		idx := (g.wfqLastIdx + 1 + step) % len(classes)
+		class := classes[idx]
+
+		best := -1
+		for i, w := range g.waiters {
+			if w.req.Weight != class {
+				continue
+			}
+			if best < 0 || w.seq < g.waiters[best].seq {
+				best = i
+			}
+		}
+		if best >= 0 {
+			g.wfqLastIdx = idx
+			return best
+		}
+	}
+
+	return -1
+}
+
+func (g *taskGate) removeWaiterLocked(w *gateWaiter) {
+	for i, o := range g.waiters {
+		if o == w {
+			g.waiters = append(g.waiters[:i], g.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (g *taskGate) Stats() TaskGateStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	s := g.stats
+	s.QueueDepth = len(g.waiters)
+	s.InFlight = g.inFlight
+	return s
+}
+
+// reportLocked pushes the gate's current queue depth and in-flight count to
+// Prometheus. Must hold g.mu.
+func (g *taskGate) reportLocked() {
+	gateQueueDepth.WithLabelValues(g.name).Set(float64(len(g.waiters)))
+	gateInFlight.WithLabelValues(g.name).Set(float64(g.inFlight))
+}
+
+// gateConcurrency returns the configured concurrency for tt (default 1,
+// matching the one-at-a-time behavior the old per-task mutexes gave every
+// task type).
+func gateConcurrency(cfg WorkerConfig, tt sealtasks.TaskType) int {
+	if n, ok := cfg.TaskGateConcurrency[tt]; ok && n > 0 {
+		return n
+	}
+	return 1
+}
+
+// gatePolicy returns the configured GatePolicy for tt (default FIFOPolicy).
+func gatePolicy(cfg WorkerConfig, tt sealtasks.TaskType) GatePolicy {
+	if p, ok := cfg.TaskGatePolicy[tt]; ok {
+		return p
+	}
+	return FIFOPolicy
+}
+
+// gateWeightForSector is the WFQPolicy weight class for sector: its sector
+// size, so WFQPolicy round-robins across size classes rather than treating
+// every sector as identical.
+func gateWeightForSector(sector storage.SectorRef) int {
+	ssize, err := sector.ProofType.SectorSize()
+	if err != nil {
+		return 0
+	}
+	return int(ssize)
+}
+
+var (
+	gateQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "lotus",
+		Subsystem: "sectorstorage",
+		Name:      "taskgate_queue_depth",
+		Help:      "Number of calls currently waiting on a LocalWorker TaskGate, by task type.",
+	}, []string{"task_type"})
+
+	gateInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "lotus",
+		Subsystem: "sectorstorage",
+		Name:      "taskgate_in_flight",
+		Help:      "Number of calls currently admitted through a LocalWorker TaskGate, by task type.",
+	}, []string{"task_type"})
+)
+
+func init() {
+	prometheus.MustRegister(gateQueueDepth, gateInFlight)
+}
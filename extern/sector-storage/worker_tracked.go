@@ -0,0 +1,87 @@
+package sectorstorage
+
+import (
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-statestore"
+	"github.com/filecoin-project/specs-storage/storage"
+
+	"github.com/filecoin-project/lotus/extern/sector-storage/storiface"
+)
+
+// resumeArgs is the subset of a resumable task's input arguments worth
+// checkpointing to the statestore before work begins, so a restarted worker
+// can re-dispatch the same sb.SealPreCommit1/SealPreCommit2/SealCommit1/
+// SealCommit2 call instead of aborting it with ErrTempWorkerRestart. Only
+// the fields the call's ReturnType actually needs are populated; see
+// resumers.
+type resumeArgs struct {
+	Ticket abi.SealRandomness
+	Seed   abi.InteractiveSealRandomness
+	Pieces []abi.PieceInfo
+	Cids   *storage.SectorCids
+
+	// Phase1Out is storage.PreCommit1Out (for SealPreCommit2) or
+	// storage.Commit1Out (for SealCommit2); both are plain []byte, so one
+	// field covers either depending on RetType.
+	Phase1Out []byte
+}
+
+// trackedWorkerCall is what workerCallTracker persists for each in-flight
+// asyncCall, keyed by CallID, so newLocalWorker can find work that didn't
+// finish before the worker process died.
+type trackedWorkerCall struct {
+	ID      storiface.CallID
+	RetType ReturnType
+	Sector  storage.SectorRef
+
+	// Resume is non-nil only for ReturnTypes with an entry in resumers;
+	// every other in-flight call is aborted on restart exactly as before.
+	Resume *resumeArgs
+}
+
+// workerCallTracker persists the set of in-flight asyncCalls so
+// newLocalWorker can find work a previous incarnation of this worker didn't
+// finish, either to resume it (see resumers in worker_local.go) or, failing
+// that, to at least tell the manager it needs rescheduling instead of
+// waiting on a CallID that will never be returned.
+type workerCallTracker struct {
+	st *statestore.StateStore
+}
+
+func (wt *workerCallTracker) onStart(ci storiface.CallID, sector storage.SectorRef, rt ReturnType, resume *resumeArgs) error {
+	return wt.st.Begin(ci, &trackedWorkerCall{
+		ID:      ci,
+		RetType: rt,
+		Sector:  sector,
+		Resume:  resume,
+	})
+}
+
+func (wt *workerCallTracker) onDone(ci storiface.CallID, ret []byte) error {
+	if has, err := wt.st.Has(ci); err != nil {
+		return err
+	} else if !has {
+		return nil
+	}
+
+	return wt.st.Get(ci).End()
+}
+
+func (wt *workerCallTracker) onReturned(ci storiface.CallID) error {
+	if has, err := wt.st.Has(ci); err != nil {
+		return err
+	} else if !has {
+		return nil
+	}
+
+	return wt.st.Get(ci).End()
+}
+
+func (wt *workerCallTracker) unfinished() ([]trackedWorkerCall, error) {
+	var out []trackedWorkerCall
+	if err := wt.st.List(&out); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
@@ -0,0 +1,67 @@
+// Package consensus ties together the available ClusterConsensus backends
+// (raft, crdt, ...) behind a single configuration knob so the rest of Lotus
+// does not need to hard-code which one is in use.
+package consensus
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	raftconsensus "github.com/filecoin-project/lotus/lib/consensus/raft"
+)
+
+// BackendType selects which ClusterConsensus implementation a node starts
+// with. It is read from node config at start-up.
+type BackendType string
+
+const (
+	// BackendRaft uses single-leader Raft (lib/consensus/raft). This is the
+	// default and the only backend Lotus has historically shipped.
+	BackendRaft BackendType = "raft"
+
+	// BackendCRDT uses a leaderless CRDT datastore replicated over libp2p
+	// pubsub (lib/consensus/crdt). There is no leader election, so writes
+	// are accepted by every peer and merged through the CRDT DAG.
+	BackendCRDT BackendType = "crdt"
+)
+
+// DefaultBackend is used when node config does not specify one, preserving
+// existing behavior for upgrades.
+const DefaultBackend = BackendRaft
+
+// ConsensusBackend is the surface both the raft and crdt backends implement.
+// It exists so the dependency-injection constructors in node/modules can
+// build whichever backend BackendType selects instead of hard-coding Raft;
+// see raft.Consensus and crdt.Consensus for the two current implementations.
+//
+// Both implementations share raftconsensus.ConsensusOp and
+// raftconsensus.RaftState as their operation/state types: the crdt backend
+// reuses them rather than inventing a parallel set, so callers that only
+// deal with committed ops and the resulting state don't need a backend
+// switch of their own.
+type ConsensusBackend interface {
+	Commit(ctx context.Context, op *raftconsensus.ConsensusOp) error
+	State(ctx context.Context) (*raftconsensus.RaftState, error)
+	StateStream(ctx context.Context) (<-chan raftconsensus.StateEntry, error)
+
+	AddPeer(ctx context.Context, pid peer.ID) error
+	RmPeer(ctx context.Context, pid peer.ID) error
+	Peers(ctx context.Context) ([]peer.ID, error)
+
+	Leader(ctx context.Context) (peer.ID, error)
+	IsLeader(ctx context.Context) bool
+	IsTrustedPeer(ctx context.Context, p peer.ID) bool
+
+	Ready(ctx context.Context) <-chan struct{}
+	WaitForSync(ctx context.Context) error
+	RedirectToLeader(method string, arg interface{}, ret interface{}) (bool, error)
+
+	Clean(ctx context.Context) error
+	Shutdown(ctx context.Context) error
+}
+
+// raftconsensus.Consensus is declared independently (to keep this package
+// from being a dependency of lib/consensus/raft) but is structurally
+// identical, so any raft.Consensus is usable as a ConsensusBackend.
+var _ ConsensusBackend = raftconsensus.Consensus(nil)
@@ -0,0 +1,55 @@
+package crdt
+
+import (
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"golang.org/x/xerrors"
+)
+
+// Config holds the configuration for the CRDT consensus backend. It plays
+// the same role raft.ClusterRaftConfig plays for the Raft backend, but most
+// of the fields that only make sense for a leader-elected log (election
+// timeouts, heartbeat interval, ...) have no equivalent here.
+type Config struct {
+	// Datastore backs the CRDT DAG. Unlike Raft's boltdb log this can be
+	// any go-datastore implementation; an in-memory one is fine for
+	// short-lived nodes, a persistent one is recommended otherwise.
+	Datastore ds.Datastore
+
+	// DatastoreNamespace prefixes every key the CRDT store writes, so a
+	// single underlying Datastore can be shared with other subsystems.
+	DatastoreNamespace string
+
+	// RebroadcastInterval controls how often the CRDT datastore
+	// re-announces its current heads over pubsub, so that peers who missed
+	// a delta can catch up.
+	RebroadcastInterval time.Duration
+
+	// HostShutdown governs whether Shutdown() also closes the libp2p host,
+	// mirroring raft.ClusterRaftConfig.HostShutdown.
+	HostShutdown bool
+}
+
+// DefaultConfig returns a Config with the same rebroadcast cadence
+// go-ds-crdt itself defaults to.
+func DefaultConfig() *Config {
+	return &Config{
+		DatastoreNamespace:  "/cluster-crdt",
+		RebroadcastInterval: time.Minute,
+	}
+}
+
+// ValidateConfig checks that cfg is usable.
+func ValidateConfig(cfg *Config) error {
+	if cfg == nil {
+		return xerrors.New("crdt: config can not be nil")
+	}
+	if cfg.Datastore == nil {
+		return xerrors.New("crdt: Datastore must be set")
+	}
+	if cfg.RebroadcastInterval <= 0 {
+		return xerrors.New("crdt: RebroadcastInterval must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,348 @@
+// Package crdt implements a Consensus component for IPFS Cluster which uses
+// a CRDT-backed datastore (go-ds-crdt) replicated over libp2p pubsub instead
+// of a single-leader Raft log.
+package crdt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+
+	addr "github.com/filecoin-project/go-address"
+
+	"github.com/filecoin-project/lotus/chain/messagepool"
+	"github.com/filecoin-project/lotus/chain/types"
+	lconsensus "github.com/filecoin-project/lotus/lib/consensus"
+	raftconsensus "github.com/filecoin-project/lotus/lib/consensus/raft"
+	"github.com/filecoin-project/lotus/node/repo"
+
+	ds "github.com/ipfs/go-datastore"
+	namespace "github.com/ipfs/go-datastore/namespace"
+	crdt "github.com/ipfs/go-ds-crdt"
+	logging "github.com/ipfs/go-log/v2"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	host "github.com/libp2p/go-libp2p/core/host"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+var logger = logging.Logger("crdt-consensus")
+
+// topicName is the libp2p pubsub topic used to broadcast CRDT deltas between
+// peers. All peers running the crdt backend for a given cluster must share
+// it.
+const topicName = "/lotus/cluster/crdt"
+
+// Consensus implements a leaderless, CRDT-backed alternative to
+// raft.Consensus. Every peer accepts writes locally and the CRDT DAG merges
+// concurrent updates, so there is no RedirectToLeader step and no notion of
+// a single leader.
+type Consensus struct {
+	ctx    context.Context
+	cancel func()
+	config *Config
+
+	host host.Host
+	repo repo.LockedRepo
+
+	store     ds.Datastore
+	datastore *crdt.Datastore
+	broadcast *crdt.PubSubBroadcaster
+
+	mpool *messagepool.MessagePool
+
+	readyCh chan struct{}
+}
+
+// NewConsensus builds a new CRDT-backed ClusterConsensus component.
+//
+// Unlike raft.NewConsensus, there is no staging parameter: new peers simply
+// start subscribing to the pubsub topic and pull in whatever state their
+// peers have already broadcast.
+func NewConsensus(host host.Host, cfg *Config, mpool *messagepool.MessagePool, repo repo.LockedRepo) (*Consensus, error) {
+	if err := ValidateConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ps, err := pubsub.NewGossipSub(ctx, host)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("creating pubsub: %w", err)
+	}
+
+	bcast, err := crdt.NewPubSubBroadcaster(ctx, ps, topicName)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("creating pubsub broadcaster: %w", err)
+	}
+
+	store := namespace.Wrap(cfg.Datastore, ds.NewKey(cfg.DatastoreNamespace))
+
+	opts := crdt.DefaultOptions()
+	opts.Logger = logger
+	opts.RebroadcastInterval = cfg.RebroadcastInterval
+	// PutHook fires for every key written into the CRDT store, whether it
+	// came from this node's own Commit or from merging a delta a peer
+	// broadcast - unlike calling mpool.Add directly from Commit, this is
+	// the one place every node (originator or not) observes a Put, so it's
+	// what keeps every peer's mempool in sync with the agreed-upon state.
+	opts.PutHook = func(k ds.Key, v []byte) {
+		op, err := unmarshalOp(v)
+		if err != nil {
+			logger.Warnf("skipping undecodable crdt put %s: %s", k, err)
+			return
+		}
+		if err := mpool.Add(context.Background(), op.SignedMsg); err != nil {
+			logger.Warnf("adding message from crdt put %s to mpool: %s", k, err)
+		}
+	}
+
+	datastore, err := crdt.New(store, ds.NewKey("crdt"), nil, bcast, opts)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("creating crdt datastore: %w", err)
+	}
+
+	cc := &Consensus{
+		ctx:       ctx,
+		cancel:    cancel,
+		config:    cfg,
+		host:      host,
+		repo:      repo,
+		store:     store,
+		datastore: datastore,
+		broadcast: bcast,
+		mpool:     mpool,
+		readyCh:   make(chan struct{}, 1),
+	}
+
+	go cc.finishBootstrap()
+	return cc, nil
+}
+
+// opKey returns the datastore key a ConsensusOp is stored under: the
+// combination of the signer's address and the message uuid keeps concurrent
+// writes from different addresses (or retries of the same message) from
+// clobbering each other.
+func opKey(a addr.Address, u uuid.UUID) ds.Key {
+	return ds.NewKey(fmt.Sprintf("%s|%s", a.String(), u.String()))
+}
+
+func (cc *Consensus) finishBootstrap() {
+	// A CRDT store has no leader to wait for; it is ready as soon as it has
+	// caught up on whatever deltas its peers had already broadcast.
+	if err := cc.datastore.Sync(cc.ctx, ds.NewKey("/")); err != nil {
+		logger.Warnf("syncing crdt store on startup: %s", err)
+	}
+	logger.Debug("crdt consensus ready")
+	cc.readyCh <- struct{}{}
+}
+
+// Ready returns a channel which is signaled once the CRDT store has synced
+// with its pubsub peers.
+func (cc *Consensus) Ready(ctx context.Context) <-chan struct{} {
+	return cc.readyCh
+}
+
+// WaitForSync blocks until the CRDT datastore has processed every delta it
+// has heard about so far.
+func (cc *Consensus) WaitForSync(ctx context.Context) error {
+	return cc.datastore.Sync(ctx, ds.NewKey("/"))
+}
+
+// RedirectToLeader always returns false: there is no leader in a CRDT
+// consensus, every peer may commit directly.
+func (cc *Consensus) RedirectToLeader(method string, arg interface{}, ret interface{}) (bool, error) {
+	return false, nil
+}
+
+// Commit applies a ConsensusOp locally and lets the CRDT layer broadcast the
+// resulting delta to the rest of the cluster. Adding op.SignedMsg to the
+// mempool happens in the PutHook passed to crdt.New (see NewConsensus), not
+// here, since that fires for every peer that observes this Put - including
+// ones merging it in from the DAG/pubsub, not just the one that called
+// Commit.
+func (cc *Consensus) Commit(ctx context.Context, op *raftconsensus.ConsensusOp) error {
+	return cc.datastore.Put(ctx, opKey(op.Addr, op.Uuid), mustMarshal(op))
+}
+
+// AddPeer is a no-op: CRDT peers are discovered through libp2p, not added to
+// a membership log.
+func (cc *Consensus) AddPeer(ctx context.Context, pid peer.ID) error {
+	logger.Debugf("AddPeer is a no-op for the crdt backend (peer %s discovered via libp2p)", pid)
+	return nil
+}
+
+// RmPeer is a no-op for the same reason AddPeer is.
+func (cc *Consensus) RmPeer(ctx context.Context, pid peer.ID) error {
+	logger.Debugf("RmPeer is a no-op for the crdt backend (peer %s discovered via libp2p)", pid)
+	return nil
+}
+
+// Peers returns the peers currently connected to the pubsub topic.
+func (cc *Consensus) Peers(ctx context.Context) ([]peer.ID, error) {
+	return cc.broadcast.Peers(), nil
+}
+
+// Leader has no meaning for a leaderless backend; it always returns the
+// local peer ID so that code written against the Consensus surface that
+// checks "am I the leader" keeps working.
+func (cc *Consensus) Leader(ctx context.Context) (peer.ID, error) {
+	return cc.host.ID(), nil
+}
+
+// IsLeader always returns true: CRDTs have no leader, so every peer accepts
+// writes.
+func (cc *Consensus) IsLeader(ctx context.Context) bool {
+	return true
+}
+
+// IsTrustedPeer returns true for every peer currently connected to the
+// pubsub topic (the same set Peers returns).
+func (cc *Consensus) IsTrustedPeer(ctx context.Context, p peer.ID) bool {
+	for _, known := range cc.broadcast.Peers() {
+		if known == p {
+			return true
+		}
+	}
+	return false
+}
+
+// State reconstructs a raftconsensus.RaftState from the CRDT key space by
+// replaying every Put under the datastore's root key.
+func (cc *Consensus) State(ctx context.Context) (*raftconsensus.RaftState, error) {
+	state := &raftconsensus.RaftState{
+		NonceMap: make(map[addr.Address]uint64),
+		MsgUuids: make(map[uuid.UUID]*types.SignedMessage),
+		Mpool:    cc.mpool,
+	}
+
+	results, err := cc.datastore.Query(ctx, ds.Query{Prefix: "/"})
+	if err != nil {
+		return nil, fmt.Errorf("querying crdt datastore: %w", err)
+	}
+	defer results.Close() // nolint
+
+	for entry := range results.Next() {
+		if entry.Error != nil {
+			return nil, fmt.Errorf("iterating crdt datastore: %w", entry.Error)
+		}
+
+		op, err := unmarshalOp(entry.Value)
+		if err != nil {
+			logger.Warnf("skipping undecodable crdt entry %s: %s", entry.Key, err)
+			continue
+		}
+
+		state.NonceMap[op.Addr] = op.Nonce
+		state.MsgUuids[op.Uuid] = op.SignedMsg
+	}
+
+	return state, nil
+}
+
+// StateStream walks the CRDT key space the same way State does, but yields
+// one entry at a time instead of building the combined RaftState in memory
+// first. It exists to satisfy lib/consensus.ConsensusBackend alongside
+// raft.Consensus; unlike the Raft backend the CRDT datastore is already
+// queried incrementally (crdt.Datastore.Query streams from its own
+// underlying store), so this mostly just forwards that iteration.
+func (cc *Consensus) StateStream(ctx context.Context) (<-chan raftconsensus.StateEntry, error) {
+	results, err := cc.datastore.Query(ctx, ds.Query{Prefix: "/"})
+	if err != nil {
+		return nil, fmt.Errorf("querying crdt datastore: %w", err)
+	}
+
+	ch := make(chan raftconsensus.StateEntry)
+	go func() {
+		defer close(ch)
+		defer results.Close() // nolint
+
+		for entry := range results.Next() {
+			if entry.Error != nil {
+				logger.Warnf("iterating crdt datastore: %s", entry.Error)
+				return
+			}
+
+			op, err := unmarshalOp(entry.Value)
+			if err != nil {
+				logger.Warnf("skipping undecodable crdt entry %s: %s", entry.Key, err)
+				continue
+			}
+
+			select {
+			case ch <- raftconsensus.StateEntry{Nonce: &raftconsensus.NonceMapEntry{Addr: op.Addr, Nonce: op.Nonce}}:
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case ch <- raftconsensus.StateEntry{MsgUuid: &raftconsensus.MsgUuidEntry{Uuid: op.Uuid, SignedMsg: op.SignedMsg}}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// Clean deletes every key in the CRDT datastore through the CRDT layer. It
+// does not touch pubsub state.
+func (cc *Consensus) Clean(ctx context.Context) error {
+	results, err := cc.datastore.Query(ctx, ds.Query{Prefix: "/", KeysOnly: true})
+	if err != nil {
+		return fmt.Errorf("querying crdt datastore: %w", err)
+	}
+	defer results.Close() // nolint
+
+	for entry := range results.Next() {
+		if entry.Error != nil {
+			return fmt.Errorf("iterating crdt datastore: %w", entry.Error)
+		}
+		if err := cc.datastore.Delete(ctx, ds.NewKey(entry.Key)); err != nil {
+			return fmt.Errorf("deleting %s: %w", entry.Key, err)
+		}
+	}
+
+	return nil
+}
+
+// Shutdown stops the pubsub broadcaster and the underlying CRDT datastore.
+func (cc *Consensus) Shutdown(ctx context.Context) error {
+	logger.Info("stopping crdt consensus component")
+
+	if err := cc.datastore.Close(); err != nil {
+		logger.Error(err)
+	}
+
+	if cc.config.HostShutdown {
+		cc.host.Close()
+	}
+
+	cc.cancel()
+	return nil
+}
+
+func mustMarshal(op *raftconsensus.ConsensusOp) []byte {
+	b, err := json.Marshal(op)
+	if err != nil {
+		// ConsensusOp only contains serializable fields; a marshal failure
+		// here means a programming error, not a runtime condition.
+		panic(err)
+	}
+	return b
+}
+
+func unmarshalOp(b []byte) (*raftconsensus.ConsensusOp, error) {
+	op := &raftconsensus.ConsensusOp{}
+	if err := json.Unmarshal(b, op); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+var _ lconsensus.ConsensusBackend = &Consensus{}
@@ -8,9 +8,12 @@ import (
 	"fmt"
 	"github.com/filecoin-project/lotus/lib/addrutil"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	"golang.org/x/exp/slices"
 
 	addr "github.com/filecoin-project/go-address"
@@ -67,22 +70,76 @@ type ConsensusOp struct {
 	Uuid      uuid.UUID            `codec:"uuid,omitempty"`
 	Addr      addr.Address         `codec:"addr,omitempty"`
 	SignedMsg *types.SignedMessage `codec:"signedMsg,omitempty"`
+
+	// SpanCtx and TagCtx carry the OpenCensus trace/tag context of the
+	// Commit call across Raft's serialized log boundary, so that ApplyTo -
+	// which may run on a different peer than the one that called Commit -
+	// still shows up as a child of the originating span instead of starting
+	// a disconnected trace.
+	SpanCtx []byte `codec:"spanCtx,omitempty"`
+	TagCtx  []byte `codec:"tagCtx,omitempty"`
 }
 
 func (c ConsensusOp) ApplyTo(state consensus.State) (consensus.State, error) {
+	ctx := context.Background()
+	if sc, ok := trace.FromBinary(c.SpanCtx); ok {
+		var span *trace.Span
+		ctx, span = trace.StartSpanWithRemoteParent(ctx, "consensus/ApplyTo", sc)
+		defer span.End()
+	}
+	if len(c.TagCtx) > 0 {
+		if tagmap, err := tag.Decode(c.TagCtx); err == nil {
+			ctx = tag.NewContext(ctx, tagmap)
+		}
+	}
+
 	s := state.(*RaftState)
 	s.NonceMap[c.Addr] = c.Nonce
 	s.MsgUuids[c.Uuid] = c.SignedMsg
-	s.Mpool.Add(context.TODO(), c.SignedMsg)
+	if err := s.Mpool.Add(ctx, c.SignedMsg); err != nil {
+		recordMempoolApplyFailure(ctx)
+		logger.Warnf("applying committed message to mempool: %s", err)
+	}
 	return s, nil
 }
 
 var _ consensus.Op = &ConsensusOp{}
 
-// Consensus handles the work of keeping a shared-state between
-// the peers of an IPFS Cluster, as well as modifying that state and
-// applying any updates in a thread-safe manner.
-type Consensus struct {
+// Consensus is the interface the rest of Lotus programs against: keeping a
+// shared state between the peers of an IPFS Cluster, modifying that state,
+// and applying updates in a thread-safe manner. raftConsensus (below) is the
+// only implementation Lotus has historically shipped; lib/consensus/crdt
+// implements the same method set (structurally identical to
+// lib/consensus.ConsensusBackend) so node/modules can build either one
+// without this package hard-coding which is in use.
+type Consensus interface {
+	Commit(ctx context.Context, op *ConsensusOp) error
+	State(ctx context.Context) (*RaftState, error)
+	StateStream(ctx context.Context) (<-chan StateEntry, error)
+
+	AddPeer(ctx context.Context, pid peer.ID) error
+	RmPeer(ctx context.Context, pid peer.ID) error
+	Peers(ctx context.Context) ([]peer.ID, error)
+
+	Leader(ctx context.Context) (peer.ID, error)
+	IsLeader(ctx context.Context) bool
+	IsTrustedPeer(ctx context.Context, p peer.ID) bool
+
+	Ready(ctx context.Context) <-chan struct{}
+	WaitForSync(ctx context.Context) error
+	RedirectToLeader(method string, arg interface{}, ret interface{}) (bool, error)
+
+	Clean(ctx context.Context) error
+	Shutdown(ctx context.Context) error
+}
+
+var _ Consensus = &raftConsensus{}
+
+// raftConsensus implements Consensus using single-leader Raft
+// (go-libp2p-raft). Everything Raft-specific - the raftWrapper, the
+// libp2praft.Actor, the peerSet, staging mode - lives behind this type so
+// callers that only depend on Consensus never need to know Raft is involved.
+type raftConsensus struct {
 	ctx    context.Context
 	cancel func()
 	config *ClusterRaftConfig
@@ -101,8 +158,11 @@ type Consensus struct {
 	peerSet []peer.ID
 	repo    repo.LockedRepo
 
-	//shutdownLock sync.RWMutex
-	//shutdown     bool
+	leaderMu   sync.Mutex
+	lastLeader peer.ID
+
+	shutdownLock sync.RWMutex
+	shutdown     bool
 }
 
 // NewConsensus builds a new ClusterConsensus component using Raft.
@@ -113,7 +173,7 @@ type Consensus struct {
 //
 // The staging parameter controls if the Raft peer should start in
 // staging mode (used when joining a new Raft peerset with other peers).
-func NewConsensus(host host.Host, cfg *ClusterRaftConfig, mpool *messagepool.MessagePool, repo repo.LockedRepo, staging bool) (*Consensus, error) {
+func NewConsensus(host host.Host, cfg *ClusterRaftConfig, mpool *messagepool.MessagePool, repo repo.LockedRepo, staging bool) (Consensus, error) {
 	err := ValidateConfig(cfg)
 	if err != nil {
 		return nil, err
@@ -144,7 +204,7 @@ func NewConsensus(host host.Host, cfg *ClusterRaftConfig, mpool *messagepool.Mes
 		host.Peerstore().AddAddrs(addrInfo.ID, addrInfo.Addrs, time.Duration(time.Hour*100))
 	}
 
-	cc := &Consensus{
+	cc := &raftConsensus{
 		ctx:       ctx,
 		cancel:    cancel,
 		config:    cfg,
@@ -169,23 +229,24 @@ func NewConsensusWithRPCClient(staging bool) func(host host.Host,
 	rpcClient *rpc.Client,
 	mpool *messagepool.MessagePool,
 	repo repo.LockedRepo,
-) (*Consensus, error) {
+) (Consensus, error) {
 
-	return func(host host.Host, cfg *ClusterRaftConfig, rpcClient *rpc.Client, mpool *messagepool.MessagePool, repo repo.LockedRepo) (*Consensus, error) {
+	return func(host host.Host, cfg *ClusterRaftConfig, rpcClient *rpc.Client, mpool *messagepool.MessagePool, repo repo.LockedRepo) (Consensus, error) {
 		cc, err := NewConsensus(host, cfg, mpool, repo, staging)
 		if err != nil {
 			return nil, err
 		}
-		cc.rpcClient = rpcClient
-		cc.rpcReady <- struct{}{}
+		rc := cc.(*raftConsensus)
+		rc.rpcClient = rpcClient
+		rc.rpcReady <- struct{}{}
 		return cc, nil
 	}
 }
 
 // WaitForSync waits for a leader and for the state to be up to date, then returns.
-func (cc *Consensus) WaitForSync(ctx context.Context) error {
-	//ctx, span := trace.StartSpan(ctx, "consensus/WaitForSync")
-	//defer span.End()
+func (cc *raftConsensus) WaitForSync(ctx context.Context) error {
+	ctx, span := cc.startSpan(ctx, "consensus/WaitForSync")
+	defer span.End()
 
 	leaderCtx, cancel := context.WithTimeout(
 		ctx,
@@ -226,7 +287,7 @@ func (cc *Consensus) WaitForSync(ctx context.Context) error {
 // waits until there is a consensus leader and syncs the state
 // to the tracker. If errors happen, this will return and never
 // signal the component as Ready.
-func (cc *Consensus) finishBootstrap() {
+func (cc *raftConsensus) finishBootstrap() {
 	// wait until we have RPC to perform any actions.
 	select {
 	case <-cc.ctx.Done():
@@ -254,17 +315,17 @@ func (cc *Consensus) finishBootstrap() {
 // Shutdown stops the component so it will not process any
 // more updates. The underlying consensus is permanently
 // shutdown, along with the libp2p transport.
-func (cc *Consensus) Shutdown(ctx context.Context) error {
-	//ctx, span := trace.StartSpan(ctx, "consensus/Shutdown")
-	//defer span.End()
+func (cc *raftConsensus) Shutdown(ctx context.Context) error {
+	ctx, span := cc.startSpan(ctx, "consensus/Shutdown")
+	defer span.End()
 
-	//cc.shutdownLock.Lock()
-	//defer cc.shutdownLock.Unlock()
+	cc.shutdownLock.Lock()
+	defer cc.shutdownLock.Unlock()
 
-	//if cc.shutdown {
-	//	logger.Debug("already shutdown")
-	//	return nil
-	//}
+	if cc.shutdown {
+		logger.Debug("already shutdown")
+		return nil
+	}
 
 	logger.Info("stopping Consensus component")
 
@@ -278,7 +339,7 @@ func (cc *Consensus) Shutdown(ctx context.Context) error {
 		cc.host.Close()
 	}
 
-	//cc.shutdown = true
+	cc.shutdown = true
 	cc.cancel()
 	close(cc.rpcReady)
 	return nil
@@ -286,31 +347,30 @@ func (cc *Consensus) Shutdown(ctx context.Context) error {
 
 // Ready returns a channel which is signaled when the Consensus
 // algorithm has finished bootstrapping and is ready to use
-func (cc *Consensus) Ready(ctx context.Context) <-chan struct{} {
-	//_, span := trace.StartSpan(ctx, "consensus/Ready")
-	//defer span.End()
+func (cc *raftConsensus) Ready(ctx context.Context) <-chan struct{} {
+	_, span := cc.startSpan(ctx, "consensus/Ready")
+	defer span.End()
 
 	return cc.readyCh
 }
 
 // IsTrustedPeer returns true. In Raft we trust all peers.
-func (cc *Consensus) IsTrustedPeer(ctx context.Context, p peer.ID) bool {
+func (cc *raftConsensus) IsTrustedPeer(ctx context.Context, p peer.ID) bool {
 	return slices.Contains(cc.peerSet, p)
 }
 
 // Trust is a no-Op.
-func (cc *Consensus) Trust(ctx context.Context, pid peer.ID) error { return nil }
+func (cc *raftConsensus) Trust(ctx context.Context, pid peer.ID) error { return nil }
 
 // Distrust is a no-Op.
-func (cc *Consensus) Distrust(ctx context.Context, pid peer.ID) error { return nil }
+func (cc *raftConsensus) Distrust(ctx context.Context, pid peer.ID) error { return nil }
 
 // returns true if the operation was redirected to the leader
 // note that if the leader just dissappeared, the rpc call will
 // fail because we haven't heard that it's gone.
-func (cc *Consensus) RedirectToLeader(method string, arg interface{}, ret interface{}) (bool, error) {
-	//ctx, span := trace.StartSpan(cc.ctx, "consensus/RedirectToLeader")
-	//defer span.End()
-	ctx := cc.ctx
+func (cc *raftConsensus) RedirectToLeader(method string, arg interface{}, ret interface{}) (bool, error) {
+	ctx, span := cc.startSpan(cc.ctx, "consensus/RedirectToLeader")
+	defer span.End()
 
 	var finalErr error
 
@@ -358,6 +418,7 @@ func (cc *Consensus) RedirectToLeader(method string, arg interface{}, ret interf
 		)
 		if finalErr != nil {
 			logger.Errorf("retrying to redirect request to leader: %s", finalErr)
+			recordRedirectRetry()
 			time.Sleep(2 * cc.config.RaftConfig.HeartbeatTimeout)
 			continue
 		}
@@ -369,18 +430,23 @@ func (cc *Consensus) RedirectToLeader(method string, arg interface{}, ret interf
 }
 
 // commit submits a cc.consensus commit. It retries upon failures.
-func (cc *Consensus) Commit(ctx context.Context, op *ConsensusOp) error {
-	//ctx, span := trace.StartSpan(ctx, "consensus/commit")
-	//defer span.End()
-	//
-	//if cc.config.Tracing {
-	//	// required to cross the serialized boundary
-	//	Op.SpanCtx = span.SpanContext()
-	//	tagmap := tag.FromContext(ctx)
-	//	if tagmap != nil {
-	//		Op.TagCtx = tag.Encode(tagmap)
-	//	}
-	//}
+func (cc *raftConsensus) Commit(ctx context.Context, op *ConsensusOp) error {
+	ctx, span := cc.startSpan(ctx, "consensus/Commit")
+	defer span.End()
+
+	if span.IsRecordingEvents() {
+		// required to cross Raft's serialized log boundary: ApplyTo runs
+		// this op on whichever peer the leader forwards it to, which may
+		// not be us, so the span/tag context has to travel inside the op.
+		sc := span.SpanContext()
+		op.SpanCtx = trace.Binary(sc)
+		if tagmap := tag.FromContext(ctx); tagmap != nil {
+			op.TagCtx = tag.Encode(tagmap)
+		}
+	}
+
+	start := time.Now()
+	defer func() { commitLatency.Observe(time.Since(start).Seconds()) }()
 
 	var finalErr error
 	for i := 0; i <= cc.config.CommitRetries; i++ {
@@ -419,9 +485,9 @@ func (cc *Consensus) Commit(ctx context.Context, op *ConsensusOp) error {
 
 // AddPeer adds a new peer to participate in this consensus. It will
 // forward the operation to the leader if this is not it.
-func (cc *Consensus) AddPeer(ctx context.Context, pid peer.ID) error {
-	//ctx, span := trace.StartSpan(ctx, "consensus/AddPeer")
-	//defer span.End()
+func (cc *raftConsensus) AddPeer(ctx context.Context, pid peer.ID) error {
+	ctx, span := cc.startSpan(ctx, "consensus/AddPeer")
+	defer span.End()
 
 	var finalErr error
 	for i := 0; i <= cc.config.CommitRetries; i++ {
@@ -451,9 +517,9 @@ func (cc *Consensus) AddPeer(ctx context.Context, pid peer.ID) error {
 
 // RmPeer removes a peer from this consensus. It will
 // forward the operation to the leader if this is not it.
-func (cc *Consensus) RmPeer(ctx context.Context, pid peer.ID) error {
-	//ctx, span := trace.StartSpan(ctx, "consensus/RmPeer")
-	//defer span.End()
+func (cc *raftConsensus) RmPeer(ctx context.Context, pid peer.ID) error {
+	ctx, span := cc.startSpan(ctx, "consensus/RmPeer")
+	defer span.End()
 
 	var finalErr error
 	for i := 0; i <= cc.config.CommitRetries; i++ {
@@ -484,15 +550,18 @@ func (cc *Consensus) RmPeer(ctx context.Context, pid peer.ID) error {
 // last agreed-upon RaftState known by this node. No writes are allowed, as all
 // writes to the shared state should happen through the Consensus component
 // methods.
-func (cc *Consensus) State(ctx context.Context) (*RaftState, error) {
-	//_, span := trace.StartSpan(ctx, "consensus/RaftState")
-	//defer span.End()
+// State is a thin wrapper returning the current RaftState pointer as-is, for
+// callers that genuinely need the whole thing at once (e.g. to hand to code
+// outside this package). New call sites that only need to iterate can use
+// StateStream, which yields the same state one entry at a time.
+func (cc *raftConsensus) State(ctx context.Context) (*RaftState, error) {
+	_, span := cc.startSpan(ctx, "consensus/RaftState")
+	defer span.End()
 
 	st, err := cc.consensus.GetLogHead()
 	if err == libp2praft.ErrNoState {
 		return newRaftState(nil), nil
 	}
-
 	if err != nil {
 		return nil, err
 	}
@@ -505,34 +574,45 @@ func (cc *Consensus) State(ctx context.Context) (*RaftState, error) {
 
 // Leader returns the peerID of the Leader of the
 // cluster. It returns an error when there is no leader.
-func (cc *Consensus) Leader(ctx context.Context) (peer.ID, error) {
-	//_, span := trace.StartSpan(ctx, "consensus/Leader")
-	//defer span.End()
+func (cc *raftConsensus) Leader(ctx context.Context) (peer.ID, error) {
+	_, span := cc.startSpan(ctx, "consensus/Leader")
+	defer span.End()
 
-	// Note the hard-dependency on raft here...
 	raftactor := cc.actor.(*libp2praft.Actor)
-	return raftactor.Leader()
+	leader, err := raftactor.Leader()
+	if err == nil {
+		cc.leaderMu.Lock()
+		if cc.lastLeader != leader {
+			if cc.lastLeader != "" {
+				recordLeaderChange()
+			}
+			cc.lastLeader = leader
+		}
+		cc.leaderMu.Unlock()
+	}
+	return leader, err
 }
 
-// Clean removes the Raft persisted state.
-func (cc *Consensus) Clean(ctx context.Context) error {
-	//_, span := trace.StartSpan(ctx, "consensus/Clean")
-	//defer span.End()
-
-	//cc.shutdownLock.RLock()
-	//defer cc.shutdownLock.RUnlock()
-	//if !cc.shutdown {
-	//	return errors.New("consensus component is not shutdown")
-	//}
+// Clean removes the Raft persisted state. The component must already be
+// shut down: cleanRaftState deletes the boltdb log and snapshots out from
+// under Raft, which would corrupt a still-running node's state.
+func (cc *raftConsensus) Clean(ctx context.Context) error {
+	_, span := cc.startSpan(ctx, "consensus/Clean")
+	defer span.End()
+
+	cc.shutdownLock.RLock()
+	defer cc.shutdownLock.RUnlock()
+	if !cc.shutdown {
+		return errors.New("consensus component is not shutdown")
+	}
 
-	//return CleanupRaft(cc.config)
-	return nil
+	return cleanRaftState(cc.config)
 }
 
 //Rollback replaces the current agreed-upon
 //state with the state provided. Only the consensus leader
 //can perform this operation.
-//func (cc *Consensus) Rollback(state RaftState) error {
+//func (cc *raftConsensus) Rollback(state RaftState) error {
 //	// This is unused. It *might* be used for upgrades.
 //	// There is rather untested magic in libp2p-raft's FSM()
 //	// to make this possible.
@@ -541,9 +621,9 @@ func (cc *Consensus) Clean(ctx context.Context) error {
 
 // Peers return the current list of peers in the consensus.
 // The list will be sorted alphabetically.
-func (cc *Consensus) Peers(ctx context.Context) ([]peer.ID, error) {
-	//ctx, span := trace.StartSpan(ctx, "consensus/Peers")
-	//defer span.End()
+func (cc *raftConsensus) Peers(ctx context.Context) ([]peer.ID, error) {
+	ctx, span := cc.startSpan(ctx, "consensus/Peers")
+	defer span.End()
 
 	//cc.shutdownLock.RLock() // prevent shutdown while here
 	//defer cc.shutdownLock.RUnlock()
@@ -566,35 +646,16 @@ func (cc *Consensus) Peers(ctx context.Context) ([]peer.ID, error) {
 		}
 		peers = append(peers, id)
 	}
+
+	setPeersetSize(len(peers))
 	return peers, nil
 }
 
-func (cc *Consensus) IsLeader(ctx context.Context) bool {
+func (cc *raftConsensus) IsLeader(ctx context.Context) bool {
 	leader, _ := cc.Leader(ctx)
 	return leader == cc.host.ID()
 }
 
-// OfflineState state returns a cluster state by reading the Raft data and
-// writing it to the given datastore which is then wrapped as a state.RaftState.
-// Usually an in-memory datastore suffices. The given datastore should be
-// thread-safe.
-//func OfflineState(cfg *Config, store ds.Datastore) (state.RaftState, error) {
-//	r, snapExists, err := LastStateRaw(cfg)
-//	if err != nil {
-//		return nil, err
-//	}
-//
-//	st, err := dsstate.New(context.Background(), store, cfg.DatastoreNamespace, dsstate.DefaultHandle())
-//	if err != nil {
-//		return nil, err
-//	}
-//	if !snapExists {
-//		return st, nil
-//	}
-//
-//	err = st.Unmarshal(r)
-//	if err != nil {
-//		return nil, err
-//	}
-//	return st, nil
-//}
+// OfflineState, DumpOfflineState and ImportOfflineState (offline_state.go)
+// implement reading/writing cluster state with the node stopped; see that
+// file for the versioned dump format and migration registry.
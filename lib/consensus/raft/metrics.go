@@ -0,0 +1,69 @@
+package consensus
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus collectors for the raft consensus component. They are
+// registered against the default registry, the same one Lotus's metrics
+// HTTP handler (metrics.Exporter) already scrapes, so no extra wiring is
+// needed to see them show up on /debug/metrics.
+var (
+	commitLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "lotus",
+		Subsystem: "consensus_raft",
+		Name:      "commit_latency_seconds",
+		Help:      "Time spent in Consensus.Commit, including retries.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	redirectRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "lotus",
+		Subsystem: "consensus_raft",
+		Name:      "redirect_retries_total",
+		Help:      "Number of times RedirectToLeader had to retry because the redirect RPC failed.",
+	})
+
+	leaderChanges = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "lotus",
+		Subsystem: "consensus_raft",
+		Name:      "leader_changes_total",
+		Help:      "Number of times this node observed a different Raft leader than the last time it checked.",
+	})
+
+	mempoolApplyFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "lotus",
+		Subsystem: "consensus_raft",
+		Name:      "mempool_apply_failures_total",
+		Help:      "Number of times applying a committed ConsensusOp to the local mempool failed.",
+	})
+
+	peersetSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "lotus",
+		Subsystem: "consensus_raft",
+		Name:      "peerset_size",
+		Help:      "Current number of peers known to this node's Raft consensus.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(commitLatency, redirectRetries, leaderChanges, mempoolApplyFailures, peersetSize)
+}
+
+func recordMempoolApplyFailure(ctx context.Context) {
+	mempoolApplyFailures.Inc()
+}
+
+func recordRedirectRetry() {
+	redirectRetries.Inc()
+}
+
+func recordLeaderChange() {
+	leaderChanges.Inc()
+}
+
+func setPeersetSize(n int) {
+	peersetSize.Set(float64(n))
+}
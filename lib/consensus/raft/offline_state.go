@@ -0,0 +1,351 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/raft"
+	"golang.org/x/xerrors"
+
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/chain/types"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+)
+
+// stateVersion is bumped whenever RaftState's on-disk shape changes (e.g. a
+// new field gets added to ConsensusOp that older dumps don't have). It is
+// written as the "version" field of every offline state dump so a future version
+// of this code can tell which migration(s) to run before decoding the rest.
+type stateVersion uint8
+
+const currentStateVersion stateVersion = 1
+
+// stateMigrations maps "dump was written at version X" to a function that
+// upgrades the decoded RaftState to the current version. Registering a
+// migration function here is the only thing a future field addition to
+// RaftState/ConsensusOp needs to do to keep `lotus-cluster-state restore`
+// working against old dumps; this mirrors the state-migration pattern
+// ipfs-cluster itself shipped (and later removed) for the same reason.
+var stateMigrations = map[stateVersion]func(*RaftState) error{
+	1: func(*RaftState) error { return nil }, // current version, no-op
+}
+
+// offlineStateDump is the JSON-serializable form OfflineState/ImportOfflineState
+// read and write. RaftState itself isn't a great wire format (it embeds a
+// live *messagepool.MessagePool), so this only carries the two maps that
+// are actually migratable data.
+type offlineStateDump struct {
+	Version  stateVersion                        `json:"version"`
+	NonceMap map[string]uint64                    `json:"nonceMap"`
+	MsgUuids map[string]*offlineSignedMessageDump `json:"msgUuids"`
+}
+
+type offlineSignedMessageDump struct {
+	Raw []byte `json:"raw"`
+}
+
+// LastStateRaw opens the most recent Raft snapshot for cfg's data folder and
+// returns a reader over its raw (un-decoded) bytes, along with whether a
+// snapshot existed at all. It does not start Raft or touch the libp2p host,
+// so it is safe to call with the node stopped - which is the whole point:
+// state import/export and Clean must work without a running consensus
+// component holding the boltdb log open.
+//
+// Caveat: raft.FileSnapshotStore only hands back the bytes as the previous
+// writer left them. A snapshot taken by a live raftConsensus was persisted
+// by go-libp2p-raft's own FSM.Snapshot/Persist codec (that package isn't
+// vendored in this tree, so its exact wire format can't be reproduced here),
+// which is not the versioned JSON offlineStateDump shape decodeOfflineDump
+// expects. In practice that means DumpOfflineState/OfflineState only reread
+// snapshots this package itself wrote via writeSnapshot/ImportOfflineState -
+// see decodeOfflineDump.
+func LastStateRaw(cfg *ClusterRaftConfig) (io.Reader, bool, error) {
+	snaps, err := raft.NewFileSnapshotStore(cfg.GetDataFolder(), 1, nil)
+	if err != nil {
+		return nil, false, xerrors.Errorf("opening snapshot store: %w", err)
+	}
+
+	metas, err := snaps.List()
+	if err != nil {
+		return nil, false, xerrors.Errorf("listing snapshots: %w", err)
+	}
+	if len(metas) == 0 {
+		return nil, false, nil
+	}
+
+	_, rc, err := snaps.Open(metas[0].ID)
+	if err != nil {
+		return nil, false, xerrors.Errorf("opening snapshot %s: %w", metas[0].ID, err)
+	}
+	defer rc.Close() // nolint
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, rc); err != nil {
+		return nil, false, xerrors.Errorf("reading snapshot %s: %w", metas[0].ID, err)
+	}
+
+	return &buf, true, nil
+}
+
+// OfflineState reads the last Raft snapshot for cfg (the node must be
+// stopped) and decodes it into a RaftState backed by an in-memory
+// datastore-style map, without needing a running Consensus component.
+// store is unused by the current (in-memory) decode path but kept so a
+// future version that persists the reconstructed state through a
+// go-datastore-backed handle (e.g. for disaster recovery into a new boltdb
+// log) doesn't need another signature change.
+func OfflineState(cfg *ClusterRaftConfig, store ds.Datastore) (*RaftState, error) {
+	if store == nil {
+		store = dssync.MutexWrap(ds.NewMapDatastore())
+	}
+
+	r, exists, err := LastStateRaw(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return newRaftState(nil), nil
+	}
+
+	dump, err := decodeOfflineDump(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return dump.toRaftState()
+}
+
+// DumpOfflineState writes cfg's last Raft snapshot out as versioned JSON, for
+// `lotus-cluster-state dump`.
+func DumpOfflineState(cfg *ClusterRaftConfig, w io.Writer) error {
+	r, exists, err := LastStateRaw(cfg)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return xerrors.New("no raft snapshot found")
+	}
+
+	dump, err := decodeOfflineDump(r)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dump)
+}
+
+// ImportOfflineState loads a JSON dump produced by DumpOfflineState and
+// writes it back out as a fresh Raft snapshot under cfg's data folder, for
+// disaster recovery or migrating a dump produced by an older lotus version.
+func ImportOfflineState(cfg *ClusterRaftConfig, r io.Reader) error {
+	var dump offlineStateDump
+	if err := json.NewDecoder(r).Decode(&dump); err != nil {
+		return xerrors.Errorf("decoding state dump: %w", err)
+	}
+
+	if err := migrateDump(&dump); err != nil {
+		return err
+	}
+
+	state, err := dump.toRaftState()
+	if err != nil {
+		return err
+	}
+
+	return writeSnapshot(cfg, state)
+}
+
+// decodeOfflineDump decodes r as the versioned JSON offlineStateDump format
+// writeSnapshot produces. It can only read snapshots this package wrote
+// itself (via writeSnapshot or a prior ImportOfflineState): a snapshot an
+// actually-running raftConsensus wrote organically during normal operation
+// was encoded by go-libp2p-raft's own FSM codec, not this JSON shape, and
+// will fail to decode here - see the caveat on LastStateRaw. The error below
+// is the signal operators will see in that case.
+func decodeOfflineDump(r io.Reader) (*offlineStateDump, error) {
+	var dump offlineStateDump
+	if err := json.NewDecoder(r).Decode(&dump); err != nil {
+		return nil, xerrors.Errorf("decoding raft snapshot as state dump (note: this only reads dumps previously written by this package's own writeSnapshot/ImportOfflineState, not a snapshot a live raft node wrote organically): %w", err)
+	}
+	if err := migrateDump(&dump); err != nil {
+		return nil, err
+	}
+	return &dump, nil
+}
+
+func migrateDump(dump *offlineStateDump) error {
+	if dump.Version == currentStateVersion {
+		return nil
+	}
+
+	migrate, ok := stateMigrations[dump.Version]
+	if !ok {
+		return xerrors.Errorf("no migration registered for state dump version %d (current version is %d)", dump.Version, currentStateVersion)
+	}
+
+	state, err := dump.toRaftState()
+	if err != nil {
+		return err
+	}
+	if err := migrate(state); err != nil {
+		return xerrors.Errorf("migrating state dump from version %d: %w", dump.Version, err)
+	}
+
+	*dump = *fromRaftState(state)
+	dump.Version = currentStateVersion
+	return nil
+}
+
+func (d *offlineStateDump) toRaftState() (*RaftState, error) {
+	state := newRaftState(nil)
+
+	for addrStr, nonce := range d.NonceMap {
+		a, err := parseAddr(addrStr)
+		if err != nil {
+			return nil, err
+		}
+		state.NonceMap[a] = nonce
+	}
+
+	for uuidStr, msg := range d.MsgUuids {
+		u, err := parseUUID(uuidStr)
+		if err != nil {
+			return nil, err
+		}
+		sm, err := decodeSignedMessage(msg.Raw)
+		if err != nil {
+			return nil, err
+		}
+		state.MsgUuids[u] = sm
+	}
+
+	return state, nil
+}
+
+func fromRaftState(state *RaftState) *offlineStateDump {
+	dump := &offlineStateDump{
+		Version:  currentStateVersion,
+		NonceMap: make(map[string]uint64, len(state.NonceMap)),
+		MsgUuids: make(map[string]*offlineSignedMessageDump, len(state.MsgUuids)),
+	}
+
+	for a, nonce := range state.NonceMap {
+		dump.NonceMap[a.String()] = nonce
+	}
+	for u, msg := range state.MsgUuids {
+		raw, err := encodeSignedMessage(msg)
+		if err != nil {
+			logger.Warnf("skipping message %s in state dump: %s", u, err)
+			continue
+		}
+		dump.MsgUuids[u.String()] = &offlineSignedMessageDump{Raw: raw}
+	}
+
+	return dump
+}
+
+// writeSnapshot persists state as a new Raft snapshot, the inverse of
+// LastStateRaw/OfflineState. It deliberately does not try to preserve the
+// previous snapshot's Raft index/term: a restore is a disaster-recovery
+// operation, so the cluster will bootstrap a fresh log around the imported
+// state the next time it starts.
+//
+// The snapshot it writes is only readable by decodeOfflineDump, not by
+// go-libp2p-raft's FSM.Restore - a node started against a data folder whose
+// only snapshot came from here will replay from an empty FSM state and
+// rebuild from the boltdb log instead of actually restoring the imported
+// state into Raft. Making that restore path real means matching
+// go-libp2p-raft's FSM snapshot codec, which isn't vendored in this tree;
+// until then, ImportOfflineState is only guaranteed to round-trip with
+// DumpOfflineState/OfflineState (i.e. with itself), not with a live cluster.
+func writeSnapshot(cfg *ClusterRaftConfig, state *RaftState) error {
+	snaps, err := raft.NewFileSnapshotStore(cfg.GetDataFolder(), 1, nil)
+	if err != nil {
+		return xerrors.Errorf("opening snapshot store: %w", err)
+	}
+
+	dump := fromRaftState(state)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if err := enc.Encode(dump); err != nil {
+		return xerrors.Errorf("encoding state for snapshot: %w", err)
+	}
+
+	sink, err := snaps.Create(raft.SnapshotVersionMax, 1, 1, raft.Configuration{}, 1, nil)
+	if err != nil {
+		return xerrors.Errorf("creating snapshot: %w", err)
+	}
+
+	if _, err := sink.Write(buf.Bytes()); err != nil {
+		_ = sink.Cancel()
+		return xerrors.Errorf("writing snapshot: %w", err)
+	}
+
+	return sink.Close()
+}
+
+// CleanOffline removes the Raft persisted state (the boltdb log and every
+// snapshot) for cfg's data folder without needing a running Consensus
+// component, for `lotus-cluster-state clean`. Consensus.Clean is a thin
+// wrapper around the same helper for callers holding a Consensus that has
+// already been shut down.
+func CleanOffline(cfg *ClusterRaftConfig) error {
+	return cleanRaftState(cfg)
+}
+
+// cleanRaftState removes the Raft persisted state: the boltdb log and every
+// snapshot under cfg's data folder. The caller must hold the repo lock and
+// must not call this while a raftConsensus for the same repo is running.
+func cleanRaftState(cfg *ClusterRaftConfig) error {
+	dataFolder := cfg.GetDataFolder()
+
+	logPath := filepath.Join(dataFolder, "raft.db")
+	if err := os.Remove(logPath); err != nil && !os.IsNotExist(err) {
+		return xerrors.Errorf("removing raft log %s: %w", logPath, err)
+	}
+
+	snapshotsDir := filepath.Join(dataFolder, "snapshots")
+	if err := os.RemoveAll(snapshotsDir); err != nil {
+		return xerrors.Errorf("removing raft snapshots %s: %w", snapshotsDir, err)
+	}
+
+	return nil
+}
+
+func parseAddr(s string) (addr.Address, error) {
+	a, err := addr.NewFromString(s)
+	if err != nil {
+		return addr.Undef, xerrors.Errorf("parsing address %q: %w", s, err)
+	}
+	return a, nil
+}
+
+func parseUUID(s string) (uuid.UUID, error) {
+	u, err := uuid.Parse(s)
+	if err != nil {
+		return uuid.UUID{}, xerrors.Errorf("parsing uuid %q: %w", s, err)
+	}
+	return u, nil
+}
+
+func encodeSignedMessage(msg *types.SignedMessage) ([]byte, error) {
+	if msg == nil {
+		return nil, nil
+	}
+	return msg.Serialize()
+}
+
+func decodeSignedMessage(raw []byte) (*types.SignedMessage, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	return types.DecodeSignedMessage(raw)
+}
@@ -0,0 +1,150 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	addr "github.com/filecoin-project/go-address"
+	"github.com/google/uuid"
+	libp2praft "github.com/libp2p/go-libp2p-raft"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// NonceMapEntry is one entry of RaftState.NonceMap, yielded by StateStream.
+type NonceMapEntry struct {
+	Addr  addr.Address
+	Nonce uint64
+}
+
+// MsgUuidEntry is one entry of RaftState.MsgUuids, yielded by StateStream.
+type MsgUuidEntry struct {
+	Uuid      uuid.UUID
+	SignedMsg *types.SignedMessage
+}
+
+// StateEntry is a single unit of RaftState sent over a StateStream channel.
+// Exactly one of Nonce/MsgUuid is set.
+type StateEntry struct {
+	Nonce   *NonceMapEntry
+	MsgUuid *MsgUuidEntry
+}
+
+// StateStream returns the current consensus RaftState one entry at a time
+// instead of handing out the *RaftState itself. A long-lived miner's
+// MsgUuids map can grow very large, and callers that only want to walk it
+// once (such as the gorpc pagination below) can consume entries as they
+// arrive.
+func (cc *raftConsensus) StateStream(ctx context.Context) (<-chan StateEntry, error) {
+	st, err := cc.consensus.GetLogHead()
+	if err == libp2praft.ErrNoState {
+		// Nothing committed yet: an immediately-closed channel is a valid,
+		// empty stream.
+		ch := make(chan StateEntry)
+		close(ch)
+		return ch, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state, ok := st.(*RaftState)
+	if !ok {
+		return nil, errors.New("wrong state type")
+	}
+
+	ch := make(chan StateEntry)
+	go func() {
+		defer close(ch)
+
+		for a, nonce := range state.NonceMap {
+			select {
+			case ch <- StateEntry{Nonce: &NonceMapEntry{Addr: a, Nonce: nonce}}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		for u, msg := range state.MsgUuids {
+			select {
+			case ch <- StateEntry{MsgUuid: &MsgUuidEntry{Uuid: u, SignedMsg: msg}}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// StateStreamChunkRequest/Response implement cursor-based pagination of
+// StateStream over gorpc, which (unlike a local channel) has no notion of a
+// long-lived streaming call: a redirect-to-leader caller polls with
+// increasing Cursor until Response.Done is true.
+type StateStreamChunkRequest struct {
+	Cursor int
+	Limit  int
+}
+
+type StateStreamChunkResponse struct {
+	Entries []StateEntry
+	Cursor  int
+	Done    bool
+}
+
+// StateStreamChunk serves one page of the state stream over gorpc, for
+// callers that reach this node via RedirectToLeader and can't hold a local
+// Go channel open across the RPC boundary. It is naive (it re-walks and
+// re-slices the full entry list per request) but bounds the size of any
+// single RPC response, which is the actual O(pinset) problem being solved.
+func (cc *raftConsensus) StateStreamChunk(ctx context.Context, req *StateStreamChunkRequest, resp *StateStreamChunkResponse) error {
+	if req.Limit <= 0 {
+		req.Limit = 1024
+	}
+
+	entries, err := cc.snapshotEntries(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Map iteration order differs on every walk; sort so that the same
+	// Cursor selects the same entries across requests.
+	key := func(e StateEntry) string {
+		if e.Nonce != nil {
+			return "n/" + e.Nonce.Addr.String()
+		}
+		return "u/" + e.MsgUuid.Uuid.String()
+	}
+	sort.Slice(entries, func(i, j int) bool { return key(entries[i]) < key(entries[j]) })
+
+	start := req.Cursor
+	if start > len(entries) {
+		start = len(entries)
+	}
+	end := start + req.Limit
+	if end > len(entries) {
+		end = len(entries)
+	}
+
+	resp.Entries = entries[start:end]
+	resp.Cursor = end
+	resp.Done = end >= len(entries)
+	return nil
+}
+
+// snapshotEntries drains a StateStream into a slice. It exists only to back
+// StateStreamChunk's pagination; anything that can hold the channel open
+// (i.e. anything in-process) should call StateStream directly instead.
+func (cc *raftConsensus) snapshotEntries(ctx context.Context) ([]StateEntry, error) {
+	ch, err := cc.StateStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []StateEntry
+	for e := range ch {
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
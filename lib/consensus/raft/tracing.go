@@ -0,0 +1,21 @@
+package consensus
+
+import (
+	"context"
+
+	"go.opencensus.io/trace"
+)
+
+// startSpan starts an OpenCensus span for a Consensus method, honoring
+// cc.config.TracingSampleRatio. Tracing every Commit is expensive (it is
+// on the hot path for every message a miner sends), so most deployments
+// will want to sample rather than trace every call; a ratio of 0 disables
+// tracing for this component entirely.
+func (cc *raftConsensus) startSpan(ctx context.Context, name string) (context.Context, *trace.Span) {
+	sampler := trace.NeverSample()
+	if ratio := cc.config.TracingSampleRatio; ratio > 0 {
+		sampler = trace.ProbabilitySampler(ratio)
+	}
+
+	return trace.StartSpan(ctx, name, trace.WithSampler(sampler))
+}
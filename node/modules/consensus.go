@@ -0,0 +1,51 @@
+package modules
+
+import (
+	"github.com/libp2p/go-libp2p/core/host"
+
+	"github.com/filecoin-project/lotus/chain/messagepool"
+	lconsensus "github.com/filecoin-project/lotus/lib/consensus"
+	"github.com/filecoin-project/lotus/lib/consensus/crdt"
+	"github.com/filecoin-project/lotus/lib/consensus/raft"
+	"github.com/filecoin-project/lotus/node/repo"
+
+	"golang.org/x/xerrors"
+)
+
+// ClusterConsensusConfig is the DI-friendly config handed to
+// NewClusterConsensus. It carries the config for every backend
+// lib/consensus knows about plus the BackendType knob that picks one;
+// this replaces passing a bare *raft.ClusterRaftConfig through the
+// constructors and hard-coding raft.NewConsensus at the call site.
+type ClusterConsensusConfig struct {
+	Backend lconsensus.BackendType
+
+	Raft *raft.ClusterRaftConfig
+	CRDT *crdt.Config
+
+	// Staging controls whether a Raft backend is started in staging mode,
+	// i.e. joining an existing peerset rather than bootstrapping/rejoining
+	// one it already knows about. See raft.NewConsensus's staging
+	// parameter. Ignored by the CRDT backend.
+	Staging bool
+}
+
+// NewClusterConsensus builds whichever lconsensus.ConsensusBackend
+// cfg.Backend selects. It is the single place that knows both backends
+// exist, so callers (fx providers in node/builder.go) only ever see the
+// ConsensusBackend interface.
+func NewClusterConsensus(h host.Host, cfg *ClusterConsensusConfig, mpool *messagepool.MessagePool, lr repo.LockedRepo) (lconsensus.ConsensusBackend, error) {
+	backend := cfg.Backend
+	if backend == "" {
+		backend = lconsensus.DefaultBackend
+	}
+
+	switch backend {
+	case lconsensus.BackendRaft:
+		return raft.NewConsensus(h, cfg.Raft, mpool, lr, cfg.Staging)
+	case lconsensus.BackendCRDT:
+		return crdt.NewConsensus(h, cfg.CRDT, mpool, lr)
+	default:
+		return nil, xerrors.Errorf("unknown consensus backend %q", backend)
+	}
+}